@@ -0,0 +1,152 @@
+package eml
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TxnSnapshot is the latest known state of a logical transaction
+type TxnSnapshot struct {
+	LogicalTransactionId int64      `json:"logical_transaction_id"`
+	AccountId            string     `json:"account_id"`
+	Lifecycle            string     `json:"lifecycle"`
+	State                TxnState   `json:"state"`
+	Details              TxnDetails `json:"details"`
+	// The most recent event applied, later messages with a lower event ID are stale
+	Event     TxnEvent `json:"event"`
+	MessageId string   `json:"message_id"`
+}
+
+// TxnStateHandler is called for each transaction change, previous is nil the first time a transaction is seen
+type TxnStateHandler func(ctx context.Context, previous, current *TxnSnapshot, message *Message) error
+
+type TxnStateStore interface {
+	// Get returns nil when the transaction hasn't been seen
+	Get(ctx context.Context, logicalTransactionId int64) (*TxnSnapshot, error)
+	Put(ctx context.Context, snapshot *TxnSnapshot) error
+}
+
+const aggregatorLockStripes = 64
+
+// TransactionAggregator rebuilds each logical transaction from its messages, which can arrive out of order when
+// undeliverables are replayed. Use aggregator.Handle wherever a TransactionHandler is expected.
+type TransactionAggregator struct {
+	store   TxnStateStore
+	handler TxnStateHandler
+	locks   [aggregatorLockStripes]sync.Mutex
+}
+
+func NewTransactionAggregator(store TxnStateStore, h TxnStateHandler) *TransactionAggregator {
+	return &TransactionAggregator{store: store, handler: h}
+}
+
+// Handle ignores events older than the last one applied to the transaction, the snapshot is only saved once the
+// handler succeeds so a failed message can be redelivered
+func (a *TransactionAggregator) Handle(ctx context.Context, message *Message) error {
+	current := snapshotMessage(message)
+	id := current.LogicalTransactionId
+	if id == 0 {
+		return a.handler(ctx, nil, current, message)
+	}
+	lock := &a.locks[uint64(id)%aggregatorLockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous, err := a.store.Get(ctx, id)
+	if err != nil {
+		return ContextualError(err, "store.Get %d", id)
+	}
+	if previous != nil && current.Event.Id <= previous.Event.Id {
+		return nil
+	}
+	if err := a.handler(ctx, previous, current, message); err != nil {
+		return err
+	}
+	if err := a.store.Put(ctx, current); err != nil {
+		return ContextualError(err, "store.Put %d", id)
+	}
+	return nil
+}
+
+func snapshotMessage(message *Message) *TxnSnapshot {
+	return &TxnSnapshot{
+		LogicalTransactionId: message.Data.LogicalTransactionId,
+		AccountId:            message.Data.AccountId,
+		Lifecycle:            message.Data.StateChange.Lifecycle,
+		State:                message.Data.StateChange.NewState,
+		Details:              message.Data.Details,
+		Event:                message.Data.Event,
+		MessageId:            message.Id,
+	}
+}
+
+// Long enough for a transaction to go from authorisation through to settlement or reversal
+const defaultTxnStateTTL = 30 * 24 * time.Hour
+
+type txnStateEntry struct {
+	snapshot *TxnSnapshot
+	expires  time.Time
+}
+
+// MemoryTxnStateStore keeps each snapshot for a TTL after it was last updated
+type MemoryTxnStateStore struct {
+	mu        sync.Mutex
+	snapshots map[int64]txnStateEntry
+	ttl       time.Duration
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryTxnStateStore forgets transactions not updated within ttl, 30 days when zero. A message for a forgotten
+// transaction is treated as its first.
+func NewMemoryTxnStateStore(ttl time.Duration) *MemoryTxnStateStore {
+	if ttl <= 0 {
+		ttl = defaultTxnStateTTL
+	}
+	return &MemoryTxnStateStore{snapshots: map[int64]txnStateEntry{}, ttl: ttl, now: time.Now}
+}
+
+func (m *MemoryTxnStateStore) Get(_ context.Context, logicalTransactionId int64) (*TxnSnapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.snapshots[logicalTransactionId]; ok && e.expires.After(m.now()) {
+		return e.snapshot, nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryTxnStateStore) Put(_ context.Context, snapshot *TxnSnapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.sweep(now)
+	m.snapshots[snapshot.LogicalTransactionId] = txnStateEntry{snapshot: snapshot, expires: now.Add(m.ttl)}
+	return nil
+}
+
+func (m *MemoryTxnStateStore) Delete(_ context.Context, logicalTransactionId int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.snapshots, logicalTransactionId)
+	return nil
+}
+
+func (m *MemoryTxnStateStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.snapshots)
+}
+
+// Drops expired snapshots at most once per minute, must hold the lock
+func (m *MemoryTxnStateStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for id, e := range m.snapshots {
+		if !e.expires.After(now) {
+			delete(m.snapshots, id)
+		}
+	}
+}
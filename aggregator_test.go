@@ -0,0 +1,83 @@
+package eml
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func txnEventMessage(id string, logicalId, eventId int64, oldState, newState TxnState) *Message {
+	return &Message{Id: id, Data: MessageData{
+		LogicalTransactionId: logicalId,
+		StateChange:          TxnStateChange{OldState: oldState, NewState: newState},
+		Event:                TxnEvent{Id: eventId},
+	}}
+}
+
+func TestTransactionAggregator_outOfOrder(t *testing.T) {
+	type change struct {
+		from, to TxnState
+	}
+	var changes []change
+	a := NewTransactionAggregator(NewMemoryTxnStateStore(0), func(ctx context.Context, previous, current *TxnSnapshot, m *Message) error {
+		c := change{to: current.State}
+		if previous != nil {
+			c.from = previous.State
+		}
+		changes = append(changes, c)
+		return nil
+	})
+
+	assert.NoError(t, a.Handle(ctx, txnEventMessage("m1", 7, 10, StateNew, StateAuthorized)))
+	assert.NoError(t, a.Handle(ctx, txnEventMessage("m3", 7, 12, StateCleared, StatePosted)))
+	assert.NoError(t, a.Handle(ctx, txnEventMessage("m2", 7, 11, StateAuthorized, StateCleared)), "stale events are acknowledged")
+	assert.NoError(t, a.Handle(ctx, txnEventMessage("m3", 7, 12, StateCleared, StatePosted)), "redeliveries are acknowledged")
+	assert.NoError(t, a.Handle(ctx, txnEventMessage("m4", 8, 1, StateNew, StateDeclined)))
+
+	assert.Equal(t, []change{
+		{"", StateAuthorized},
+		{StateAuthorized, StatePosted},
+		{"", StateDeclined},
+	}, changes)
+}
+
+func TestTransactionAggregator_handlerError(t *testing.T) {
+	store := NewMemoryTxnStateStore(0)
+	fail := true
+	a := NewTransactionAggregator(store, func(ctx context.Context, previous, current *TxnSnapshot, m *Message) error {
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	assert.Error(t, a.Handle(ctx, txnEventMessage("m1", 7, 10, StateNew, StateAuthorized)))
+	snapshot, _ := store.Get(ctx, 7)
+	assert.Nil(t, snapshot, "failed events should not be saved")
+
+	fail = false
+	assert.NoError(t, a.Handle(ctx, txnEventMessage("m1", 7, 10, StateNew, StateAuthorized)))
+	snapshot, _ = store.Get(ctx, 7)
+	assert.Equal(t, StateAuthorized, snapshot.State)
+	assert.Equal(t, int64(10), snapshot.Event.Id)
+}
+
+func TestMemoryTxnStateStore_expiry(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryTxnStateStore(time.Hour)
+	store.now = func() time.Time { return now }
+
+	assert.NoError(t, store.Put(ctx, &TxnSnapshot{LogicalTransactionId: 7}))
+	now = now.Add(30 * time.Minute)
+	snapshot, _ := store.Get(ctx, 7)
+	assert.NotNil(t, snapshot)
+
+	now = now.Add(time.Hour)
+	snapshot, _ = store.Get(ctx, 7)
+	assert.Nil(t, snapshot, "expired snapshots are forgotten")
+	assert.NoError(t, store.Put(ctx, &TxnSnapshot{LogicalTransactionId: 8}))
+	assert.Equal(t, 1, store.Len(), "expired snapshots are swept")
+}
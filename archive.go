@@ -0,0 +1,146 @@
+package eml
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ArchivedMessage is a verified webhook as received, with sensitive fields redacted
+type ArchivedMessage struct {
+	MessageId   string      `json:"message_id"`
+	MessageType string      `json:"message_type"`
+	HookId      string      `json:"hook_id"`
+	AccountId   string      `json:"account_id,omitempty"`
+	ReceivedAt  time.Time   `json:"received_at"`
+	Headers     http.Header `json:"headers"`
+	Body        string      `json:"body"`
+}
+
+// ArchiveFilter selects archived messages, zero fields match everything
+type ArchiveFilter struct {
+	// From is inclusive and To exclusive
+	From       time.Time
+	To         time.Time
+	AccountId  string
+	MessageIds []string
+	// Replay only sends transaction messages when empty
+	MessageTypes []string
+}
+
+func (f *ArchiveFilter) matches(a *ArchivedMessage) bool {
+	if !f.From.IsZero() && a.ReceivedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !a.ReceivedAt.Before(f.To) {
+		return false
+	}
+	if f.AccountId != "" && a.AccountId != f.AccountId {
+		return false
+	}
+	if len(f.MessageIds) > 0 && !containsString(f.MessageIds, a.MessageId) {
+		return false
+	}
+	if len(f.MessageTypes) > 0 && !containsString(f.MessageTypes, a.MessageType) {
+		return false
+	}
+	return true
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Archive stores every verified webhook so it can be inspected or replayed
+type Archive interface {
+	Store(ctx context.Context, m *ArchivedMessage) error
+	// Find returns matching messages in the order they were received
+	Find(ctx context.Context, filter ArchiveFilter) ([]*ArchivedMessage, error)
+}
+
+// Builds the archive entry for a verified webhook, redacting its body and headers
+func newArchivedMessage(req *Request, messageType TransactionType, message *Message, body []byte, r *Redactor, receivedAt time.Time) *ArchivedMessage {
+	r = redactorOrDefault(r)
+	return &ArchivedMessage{
+		MessageId:   message.Id,
+		MessageType: string(messageType),
+		HookId:      message.HookId,
+		AccountId:   message.Data.AccountId,
+		ReceivedAt:  receivedAt,
+		Headers:     r.RedactHeaders(req.Header),
+		Body:        string(r.RedactBytes(body)),
+	}
+}
+
+// FileArchive appends messages to a file as lines of JSON, Find reads the whole file
+type FileArchive struct {
+	path string
+	file *jsonLinesFile
+}
+
+func NewFileArchive(path string) (*FileArchive, error) {
+	f, err := openJsonLines(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileArchive{path: path, file: f}, nil
+}
+
+func (f *FileArchive) Store(_ context.Context, m *ArchivedMessage) error {
+	return f.file.append(m, false)
+}
+
+func (f *FileArchive) Find(_ context.Context, filter ArchiveFilter) ([]*ArchivedMessage, error) {
+	var found []*ArchivedMessage
+	err := readJsonLines(f.path, func(line []byte) {
+		var m ArchivedMessage
+		// Skip a torn final line from a crash
+		if err := json.Unmarshal(line, &m); err != nil {
+			return
+		}
+		if filter.matches(&m) {
+			found = append(found, &m)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+func (f *FileArchive) Close() error {
+	return f.file.Close()
+}
+
+// Replay sends archived messages matching filter through h in the order they were received, stopping at the first
+// error. Only transaction messages are sent unless filter.MessageTypes says otherwise. Bodies were redacted when
+// archived so h sees masked values for sensitive fields.
+func Replay(ctx context.Context, archive Archive, filter ArchiveFilter, h TransactionHandler) (replayed int, err error) {
+	if len(filter.MessageTypes) == 0 {
+		filter.MessageTypes = []string{TxnTypeTransaction}
+	}
+	archived, err := archive.Find(ctx, filter)
+	if err != nil {
+		return 0, ContextualError(err, "archive.Find")
+	}
+	for _, a := range archived {
+		if err := ctx.Err(); err != nil {
+			return replayed, err
+		}
+		var message Message
+		if err := json.Unmarshal([]byte(a.Body), &message); err != nil {
+			return replayed, ContextualError(err, "json.Unmarshal %s", a.MessageId)
+		}
+		if err := h(ctx, &message); err != nil {
+			return replayed, ContextualError(err, "replay %s", a.MessageId)
+		}
+		replayed++
+	}
+	return replayed, nil
+}
@@ -0,0 +1,65 @@
+package eml
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileArchive_webhook(t *testing.T) {
+	archive, err := NewFileArchive(filepath.Join(t.TempDir(), "archive.jsonl"))
+	assert.NoError(t, err)
+	defer archive.Close()
+	deps := &Dependencies{Config: &Config{NotificationHookId: "hook1", HmacKey: testHmacKey}, Archive: archive}
+	handler := NewWebhookHandler(deps, WithTransactionHandler(func(ctx context.Context, m *Message) error { return nil }))
+	client := NewWebhookTestClient(testHmacKey, "http://localhost/eml")
+
+	m := testTxnMessage()
+	m.Data.CustomerInfo.ClientAccountKey = "5123456789012346"
+	_, _ = serveMessage(client, handler, m)
+	wrongKey := NewWebhookTestClient(&Key{Id: "key1", Secret: "b3RoZXI="}, "http://localhost/eml")
+	_, _ = serveMessage(wrongKey, handler, &Message{Id: "m2", HookId: "hook1"})
+
+	archived, err := archive.Find(ctx, ArchiveFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, archived, 1, "only verified messages are archived")
+	assert.Equal(t, "m1", archived[0].MessageId)
+	assert.Equal(t, "eaid1", archived[0].AccountId)
+	assert.Equal(t, TxnTypeTransaction, archived[0].MessageType)
+	assert.Equal(t, redactedMask, archived[0].Headers.Get(headerActualAuth))
+	assert.NotContains(t, archived[0].Body, "5123456789012346")
+}
+
+func TestReplay(t *testing.T) {
+	archive, err := NewFileArchive(filepath.Join(t.TempDir(), "archive.jsonl"))
+	assert.NoError(t, err)
+	defer archive.Close()
+	day := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, a := range []*ArchivedMessage{
+		{MessageId: "m1", AccountId: "a1", MessageType: TxnTypeTransaction, Body: `{"id":"m1"}`},
+		{MessageId: "p1", MessageType: TxnTypePing, Body: `{"id":"p1"}`},
+		{MessageId: "m2", AccountId: "a2", MessageType: TxnTypeTransaction, Body: `{"id":"m2"}`},
+		{MessageId: "m3", AccountId: "a1", MessageType: TxnTypeTransaction, Body: `{"id":"m3"}`},
+	} {
+		a.ReceivedAt = day.Add(time.Duration(i) * time.Hour)
+		assert.NoError(t, archive.Store(ctx, a))
+	}
+	replay := func(filter ArchiveFilter) []string {
+		var ids []string
+		_, err := Replay(ctx, archive, filter, func(ctx context.Context, m *Message) error {
+			ids = append(ids, m.Id)
+			return nil
+		})
+		assert.NoError(t, err)
+		return ids
+	}
+
+	assert.Equal(t, []string{"m1", "m2", "m3"}, replay(ArchiveFilter{}))
+	assert.Equal(t, []string{"m1", "m3"}, replay(ArchiveFilter{AccountId: "a1"}))
+	assert.Equal(t, []string{"m2", "m3"}, replay(ArchiveFilter{From: day.Add(time.Hour)}))
+	assert.Equal(t, []string{"m1"}, replay(ArchiveFilter{To: day.Add(time.Hour)}))
+	assert.Equal(t, []string{"m2"}, replay(ArchiveFilter{MessageIds: []string{"m2"}}))
+}
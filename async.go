@@ -0,0 +1,212 @@
+package eml
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAsyncWorkers      = 4
+	defaultAsyncMaxAttempts  = 5
+	defaultAsyncDrainTimeout = 30 * time.Second
+	maxAsyncRetryBackoff     = 5 * time.Minute
+)
+
+type AsyncOption func(*AsyncProcessor)
+
+// WithWorkers sets how many messages are handled at once, 4 by default
+func WithWorkers(n int) AsyncOption {
+	return func(p *AsyncProcessor) {
+		p.workers = n
+	}
+}
+
+// WithMaxAttempts sets how many times a message is handled before it is dead-lettered, 5 by default
+func WithMaxAttempts(n int) AsyncOption {
+	return func(p *AsyncProcessor) {
+		p.maxAttempts = n
+	}
+}
+
+// WithRetryBackoff sets the delay before the given retry, 1 being the first
+func WithRetryBackoff(backoff func(retry int) time.Duration) AsyncOption {
+	return func(p *AsyncProcessor) {
+		p.backoff = backoff
+	}
+}
+
+// WithDeadLetterStore replaces the default in-memory dead-letter store
+func WithDeadLetterStore(store DeadLetterStore) AsyncOption {
+	return func(p *AsyncProcessor) {
+		p.deadLetters = store
+	}
+}
+
+// WithDrainTimeout sets how long Run waits for messages being handled when it stops, 30s by default. Handlers'
+// contexts are cancelled after that and their messages are queued again without using up an attempt.
+func WithDrainTimeout(d time.Duration) AsyncOption {
+	return func(p *AsyncProcessor) {
+		p.drainTimeout = d
+	}
+}
+
+func WithAsyncLogger(l Logger) AsyncOption {
+	return func(p *AsyncProcessor) {
+		p.log = l
+	}
+}
+
+// AsyncProcessor acknowledges messages once they are queued and handles them on a pool of workers, retrying
+// failures with backoff and moving messages which keep failing to a dead-letter store.
+// Pass processor.Enqueue to HandleNotification, or use WithAsync, and call Run.
+type AsyncProcessor struct {
+	queue       Queue
+	handler     TransactionHandler
+	deadLetters DeadLetterStore
+	workers     int
+	maxAttempts int
+	backoff     func(retry int) time.Duration
+	// How long Run waits for in-flight messages once its context is done
+	drainTimeout time.Duration
+	log          Logger
+	now          func() time.Time
+}
+
+func NewAsyncProcessor(queue Queue, h TransactionHandler, opts ...AsyncOption) *AsyncProcessor {
+	p := &AsyncProcessor{
+		queue:        queue,
+		handler:      h,
+		workers:      defaultAsyncWorkers,
+		maxAttempts:  defaultAsyncMaxAttempts,
+		backoff:      exponentialBackoff,
+		drainTimeout: defaultAsyncDrainTimeout,
+		now:          time.Now,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.deadLetters == nil {
+		p.deadLetters = NewMemoryDeadLetterStore()
+	}
+	p.log = loggerOrNop(p.log)
+	return p
+}
+
+// 1s doubling up to 5 minutes
+func exponentialBackoff(retry int) time.Duration {
+	d := time.Second
+	for i := 1; i < retry && d < maxAsyncRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxAsyncRetryBackoff {
+		d = maxAsyncRetryBackoff
+	}
+	return d
+}
+
+func (p *AsyncProcessor) DeadLetters() DeadLetterStore {
+	return p.deadLetters
+}
+
+// Enqueue is a TransactionHandler which queues the message, failing only if it couldn't be queued so EML retries
+func (p *AsyncProcessor) Enqueue(ctx context.Context, message *Message) error {
+	if err := p.queue.Push(ctx, &QueuedMessage{Message: message}); err != nil {
+		return ContextualError(err, "queue.Push %s", message.Id)
+	}
+	return nil
+}
+
+// Run handles queued messages until ctx is done, then stops taking messages and waits up to the drain timeout for
+// the workers to finish their current message. Handlers get their own context so stopping doesn't fail them.
+func (p *AsyncProcessor) Run(ctx context.Context) error {
+	handlerCtx, cancelHandlers := context.WithCancel(context.Background())
+	defer cancelHandlers()
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx, handlerCtx)
+		}()
+	}
+	<-ctx.Done()
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	timer := time.NewTimer(p.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+		p.log.Warn("EML messages still being handled after drain timeout, cancelling them", KV("timeout", p.drainTimeout.String()))
+		cancelHandlers()
+		<-drained
+	}
+	return ctx.Err()
+}
+
+func (p *AsyncProcessor) work(ctx, handlerCtx context.Context) {
+	// Pop may still return a ready message after ctx is done, stop rather than pick up another
+	for ctx.Err() == nil {
+		m, err := p.queue.Pop(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				p.log.Error("Failed to read queued EML message", ErrField(err))
+			}
+			return
+		}
+		p.process(handlerCtx, m)
+	}
+}
+
+func (p *AsyncProcessor) process(ctx context.Context, m *QueuedMessage) {
+	m.Attempts++
+	// Recovered here too so a panicking handler can't take down a worker, whatever middleware it was built with
+	err := Recover(p.log)(p.handler)(ctx, m.Message)
+	if err == nil {
+		p.ack(m)
+		return
+	}
+	if ctx.Err() != nil {
+		// Cut short by shutdown rather than a failure of the message
+		m.Attempts--
+		p.requeue(m, 0)
+		return
+	}
+	m.LastError = err.Error()
+	if m.Attempts >= p.maxAttempts {
+		p.log.Error("EML message failed too many times, dead-lettering", KV("messageId", m.Message.Id), KV("attempts", m.Attempts), ErrField(err))
+		d := &DeadLetter{Message: m.Message, Attempts: m.Attempts, Error: m.LastError, Time: p.now()}
+		if err := p.deadLetters.Put(context.Background(), d); err != nil {
+			// Leave it unacknowledged so a durable queue retries it after a restart
+			p.log.Error("Failed to dead-letter EML message", KV("messageId", m.Message.Id), ErrField(err))
+			return
+		}
+		p.ack(m)
+		return
+	}
+	delay := p.backoff(m.Attempts)
+	p.log.Warn("EML message failed, retrying", KV("messageId", m.Message.Id), KV("attempts", m.Attempts), KV("delay", delay.String()), ErrField(err))
+	p.requeue(m, delay)
+}
+
+func (p *AsyncProcessor) requeue(m *QueuedMessage, delay time.Duration) {
+	retry := *m
+	retry.NotBefore = p.now().Add(delay)
+	// Push before acking, a crash in between means a duplicate rather than a lost message
+	if err := p.queue.Push(context.Background(), &retry); err != nil {
+		p.log.Error("Failed to requeue EML message", KV("messageId", m.Message.Id), ErrField(err))
+		return
+	}
+	p.ack(m)
+}
+
+// Queue bookkeeping isn't cancelled with the handler so a drained message is still acknowledged
+func (p *AsyncProcessor) ack(m *QueuedMessage) {
+	if err := p.queue.Ack(context.Background(), m.Seq); err != nil {
+		p.log.Error("Failed to acknowledge queued EML message", KV("messageId", m.Message.Id), ErrField(err))
+	}
+}
@@ -0,0 +1,155 @@
+package eml
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncProcessor(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	queue := NewMemoryQueue()
+	p := NewAsyncProcessor(queue, func(ctx context.Context, m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[m.Id]++
+		if m.Id == "bad" || (m.Id == "flaky" && attempts[m.Id] == 1) {
+			return errors.New("failed")
+		}
+		return nil
+	}, WithWorkers(2), WithMaxAttempts(3), WithRetryBackoff(func(int) time.Duration { return time.Millisecond }))
+
+	for _, id := range []string{"ok", "flaky", "bad"} {
+		assert.NoError(t, p.Enqueue(ctx, &Message{Id: id}))
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- p.Run(runCtx) }()
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		letters, _ := p.DeadLetters().List(ctx)
+		return len(letters) == 1 && attempts["flaky"] == 2
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	mu.Lock()
+	assert.Equal(t, map[string]int{"ok": 1, "flaky": 2, "bad": 3}, attempts)
+	mu.Unlock()
+	letters, _ := p.DeadLetters().List(ctx)
+	assert.Equal(t, "bad", letters[0].Message.Id)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.Equal(t, "failed", letters[0].Error)
+}
+
+func TestAsyncProcessor_shutdown(t *testing.T) {
+	queue := NewMemoryQueue()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handlerErr error
+	p := NewAsyncProcessor(queue, func(ctx context.Context, m *Message) error {
+		close(started)
+		<-release
+		handlerErr = ctx.Err()
+		return handlerErr
+	}, WithWorkers(1))
+	assert.NoError(t, p.Enqueue(ctx, &Message{Id: "m1"}))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- p.Run(runCtx) }()
+	<-started
+	cancel()
+	close(release)
+	assert.Equal(t, context.Canceled, <-done)
+	assert.NoError(t, handlerErr, "in-flight messages finish with a live context")
+	assert.Equal(t, 0, queue.Len())
+}
+
+func TestAsyncProcessor_drainTimeout(t *testing.T) {
+	queue := NewMemoryQueue()
+	started := make(chan struct{})
+	p := NewAsyncProcessor(queue, func(ctx context.Context, m *Message) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, WithWorkers(1), WithDrainTimeout(10*time.Millisecond))
+	assert.NoError(t, p.Enqueue(ctx, &Message{Id: "m1"}))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- p.Run(runCtx) }()
+	<-started
+	cancel()
+	<-done
+	assert.Equal(t, 1, queue.Len(), "messages cut short are queued again")
+	m, _ := queue.Pop(ctx)
+	assert.Equal(t, 0, m.Attempts, "without using up an attempt")
+}
+
+func TestAsyncProcessor_panic(t *testing.T) {
+	p := NewAsyncProcessor(NewMemoryQueue(), func(ctx context.Context, m *Message) error {
+		panic("boom")
+	}, WithWorkers(1), WithMaxAttempts(1))
+	assert.NoError(t, p.Enqueue(ctx, &Message{Id: "m1"}))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- p.Run(runCtx) }()
+	assert.Eventually(t, func() bool {
+		letters, _ := p.DeadLetters().List(ctx)
+		return len(letters) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestFileQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	queue, err := NewFileQueue(path)
+	assert.NoError(t, err)
+	for _, id := range []string{"m1", "m2", "m3"} {
+		assert.NoError(t, queue.Push(ctx, &QueuedMessage{Message: &Message{Id: id}}))
+	}
+	m, err := queue.Pop(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Ack(ctx, m.Seq))
+	_, err = queue.Pop(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Close())
+
+	reopened, err := NewFileQueue(path)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, 2, reopened.Len(), "unacknowledged messages are queued again")
+	m, _ = reopened.Pop(ctx)
+	assert.Equal(t, "m2", m.Message.Id)
+	assert.NoError(t, reopened.Push(ctx, &QueuedMessage{Message: &Message{Id: "m4"}}))
+	assert.Equal(t, int64(4), reopened.seq)
+}
+
+func TestFileDeadLetterStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	store, err := NewFileDeadLetterStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Put(ctx, &DeadLetter{Message: &Message{Id: "m1"}, Attempts: 5}))
+	assert.NoError(t, store.Put(ctx, &DeadLetter{Message: &Message{Id: "m2"}, Attempts: 5}))
+	assert.NoError(t, store.Remove(ctx, "m1"))
+	assert.NoError(t, store.Close())
+
+	reopened, err := NewFileDeadLetterStore(path)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	letters, err := reopened.List(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 1)
+	assert.Equal(t, "m2", letters[0].Message.Id)
+}
@@ -0,0 +1,138 @@
+package eml
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AuditUpdateStatus         = "update_status"
+	AuditUpdatePlasticEnabled = "update_plastic_enabled"
+	AuditUpdateRegistration   = "update_registration"
+	AuditTransfer             = "transfer"
+	AuditActivate             = "activate"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditRecord describes one call which changed an account's money or card state
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Actor     string    `json:"actor,omitempty"`
+	Eaid      string    `json:"eaid"`
+	// Values before and after the change, where known
+	Before        interface{} `json:"before,omitempty"`
+	After         interface{} `json:"after,omitempty"`
+	RequestId     string      `json:"request_id,omitempty"`
+	CorrelationId string      `json:"correlation_id,omitempty"`
+	Outcome       string      `json:"outcome"`
+	Error         string      `json:"error,omitempty"`
+}
+
+type AuditSink interface {
+	Record(ctx context.Context, record *AuditRecord) error
+}
+
+type actorKey struct{}
+
+// WithActor sets who is performing the operations made with ctx, for the audit trail
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func Actor(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+	return ""
+}
+
+// FileAuditSink appends each record to a file as a line of JSON
+type FileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, ContextualError(err, "os.OpenFile %s", path)
+	}
+	return &FileAuditSink{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (f *FileAuditSink) Record(_ context.Context, record *AuditRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.enc.Encode(record); err != nil {
+		return ContextualError(err, "json.Encode")
+	}
+	return f.file.Sync()
+}
+
+func (f *FileAuditSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// Values recorded for Activate, the security code is left out
+type auditActivation struct {
+	OperationId   string  `json:"operation_id"`
+	IPAddress     string  `json:"ip_address"`
+	EnablePlastic *string `json:"enable_plastic,omitempty"`
+}
+
+// Values recorded for UpdateRegistration, only the names of the fields changed so no personal details are audited
+type auditRegistration struct {
+	Changed []string `json:"changed_fields"`
+}
+
+func changedRegistrationFields(before, after *Registration) []string {
+	changed := make([]string, 0)
+	if after == nil {
+		return changed
+	}
+	for _, f := range []struct {
+		name       string
+		have, want string
+	}{
+		{"first_name", before.FirstName, after.FirstName},
+		{"last_name", before.LastName, after.LastName},
+		{"mobile_number", before.MobileNumber, after.MobileNumber},
+		{"email_address", before.EmailAddress, after.EmailAddress},
+	} {
+		if f.have != f.want {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed
+}
+
+// Completes the record and sends it to the configured sink, failures are logged as the change has already been made
+func (e *emlStore) audit(ctx context.Context, record *AuditRecord, err error) {
+	if e._env == nil || e._env.Audit == nil {
+		return
+	}
+	record.Time = time.Now().UTC()
+	if actor := Actor(ctx); actor != "" {
+		record.Actor = actor
+	}
+	record.CorrelationId = CorrelationId(ctx)
+	record.Outcome = AuditSuccess
+	if err != nil {
+		record.Outcome = AuditFailure
+		record.Error = err.Error()
+	}
+	if sinkErr := e._env.Audit.Record(ctx, record); sinkErr != nil {
+		e.log().Error("Unable to record audit trail", KV("operation", record.Operation), KV("eaid", record.Eaid), KV("outcome", record.Outcome), ErrField(sinkErr))
+	}
+}
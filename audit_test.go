@@ -0,0 +1,102 @@
+package eml
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test mutating calls are written to the audit file with their actor and outcome
+func Test_emlStore_Audit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileAuditSink(path)
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	e := &Settings{EmlRestId: clientId, EmlHostUrl: baseUrl, Audit: sink}
+	store := &emlStore{_restSecret: clientSecret, _env: e}
+	store.lazyInit(ctx)
+
+	httpmock.ActivateNonDefault(store._lazyClient.GetClient())
+	defer httpmock.DeactivateAndReset()
+	mockTokenResponse(t)
+	httpmock.RegisterResponder("PUT", "https://eml.com/3.0/accounts/eaid/status", httpmock.NewStringResponder(200, ""))
+	httpmock.RegisterResponder("POST", "https://eml.com/3.0/accounts/eaid/activate", httpmock.NewJsonResponderOrPanic(400, ErrorModel{Code: "invalid_code"}))
+
+	actorCtx := WithCorrelationId(WithActor(ctx, "admin@example.com"), "corr-1")
+	assert.NoError(t, store.UpdateStatus(actorCtx, "eaid", CardStatusLostStolen))
+	assert.Error(t, store.Activate(ctx, "eaid", ActivateRequest{ValidationData: ValidationData{OperationID: "op1", SecurityCode: "123456"}}))
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		assert.NotContains(t, scanner.Text(), "123456", "security code should not be audited")
+		var r map[string]interface{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	assert.Len(t, records, 2)
+
+	assert.Equal(t, AuditUpdateStatus, records[0]["operation"])
+	assert.Equal(t, "admin@example.com", records[0]["actor"])
+	assert.Equal(t, "eaid", records[0]["eaid"])
+	assert.Equal(t, string(CardStatusLostStolen), records[0]["after"])
+	assert.Equal(t, "corr-1", records[0]["correlation_id"])
+	assert.Equal(t, AuditSuccess, records[0]["outcome"])
+
+	assert.Equal(t, AuditActivate, records[1]["operation"])
+	assert.Equal(t, AuditFailure, records[1]["outcome"])
+	assert.Contains(t, records[1]["error"], "invalid_code")
+	assert.Equal(t, "op1", records[1]["after"].(map[string]interface{})["operation_id"])
+}
+
+type testRegistration struct{ email, phone, first, last string }
+
+func (r testRegistration) Uid() string       { return "cardholder1" }
+func (r testRegistration) Email() string     { return r.email }
+func (r testRegistration) Phone() string     { return r.phone }
+func (r testRegistration) FirstName() string { return r.first }
+func (r testRegistration) LastName() string  { return r.last }
+
+// Test registration updates are audited against the operator, with changed field names but no personal details
+func Test_emlStore_AuditRegistration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileAuditSink(path)
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	e := &Settings{EmlRestId: clientId, EmlHostUrl: baseUrl, Audit: sink}
+	store := &emlStore{_restSecret: clientSecret, _env: e}
+	store.lazyInit(ctx)
+
+	httpmock.ActivateNonDefault(store._lazyClient.GetClient())
+	defer httpmock.DeactivateAndReset()
+	mockTokenResponse(t)
+	httpmock.RegisterResponder("GET", "https://eml.com/3.0/accounts/eaid", httpmock.NewJsonResponderOrPanic(200, AccountInfo{Personal: &Registration{
+		FirstName: "Jo", LastName: "Bloggs", DateOfBirth: "1980-01-01", EmailAddress: "old@example.com", MobileNumber: "0400000000",
+		PrimaryAddress: &Address{Line1: "1 Secret St"},
+	}}))
+	httpmock.RegisterResponder("PUT", "https://eml.com/3.0/accounts/eaid", httpmock.NewStringResponder(200, ""))
+
+	info := testRegistration{email: "new@example.com", phone: "0400000000", first: "Jo", last: "Bloggs"}
+	assert.NoError(t, store.UpdateRegistration(WithActor(ctx, "admin@example.com"), "eaid", info))
+
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	for _, pii := range []string{"old@example.com", "new@example.com", "Bloggs", "1980-01-01", "Secret St", "cardholder1"} {
+		assert.NotContains(t, string(b), pii)
+	}
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal(b, &record))
+	assert.Equal(t, "admin@example.com", record["actor"])
+	assert.Equal(t, []interface{}{"email_address"}, record["after"].(map[string]interface{})["changed_fields"])
+}
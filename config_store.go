@@ -0,0 +1,116 @@
+package eml
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// HookState is our webhook as SetupHook left it, what Config needs to accept its messages after a restart
+type HookState struct {
+	HookId  string `json:"hook_id"`
+	Uri     string `json:"uri"`
+	Scope   []int  `json:"scope,omitempty"`
+	Enabled bool   `json:"enabled"`
+	// Nil when an existing hook was kept without a configured key, so the secret it uses isn't known
+	HmacKey *Key `json:"hmac_key,omitempty"`
+}
+
+// ConfigStore saves the hook state Dependencies.SetupHook ends up with. It holds the HMAC secret so should be kept
+// somewhere as private as the rest of the config.
+type ConfigStore interface {
+	// LoadHookState returns nil when nothing has been saved
+	LoadHookState(ctx context.Context) (*HookState, error)
+	SaveHookState(ctx context.Context, state *HookState) error
+}
+
+// ApplyHookState points c at the saved hook and its key. When a key ring is in use the key is accepted alongside it,
+// unless the ring has the key's ID, so retiring it still works. c isn't locked, so call it before webhooks are
+// being handled.
+func (c *Config) ApplyHookState(state *HookState) {
+	if state == nil {
+		return
+	}
+	c.NotificationHookId = state.HookId
+	if state.HmacKey != nil {
+		c.HmacKey = state.HmacKey
+		c.hookKey = state.HmacKey
+	}
+}
+
+// LoadHookState applies any saved hook state to c
+func (c *Config) LoadHookState(ctx context.Context, store ConfigStore) error {
+	state, err := store.LoadHookState(ctx)
+	if err != nil {
+		return ContextualError(err, "store.LoadHookState")
+	}
+	c.ApplyHookState(state)
+	return nil
+}
+
+// MemoryConfigStore keeps the hook state for the life of the process
+type MemoryConfigStore struct {
+	mu    sync.RWMutex
+	state *HookState
+}
+
+func NewMemoryConfigStore() *MemoryConfigStore {
+	return &MemoryConfigStore{}
+}
+
+func (m *MemoryConfigStore) LoadHookState(context.Context) (*HookState, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state, nil
+}
+
+func (m *MemoryConfigStore) SaveHookState(_ context.Context, state *HookState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = state
+	return nil
+}
+
+// FileConfigStore keeps the hook state in a file only the process user can read
+type FileConfigStore struct {
+	*MemoryConfigStore
+	path string
+}
+
+// NewFileConfigStore loads any hook state saved at path
+func NewFileConfigStore(path string) (*FileConfigStore, error) {
+	mem := NewMemoryConfigStore()
+	var lineErr error
+	err := readJsonLines(path, func(line []byte) {
+		var state HookState
+		if err := json.Unmarshal(line, &state); err != nil {
+			lineErr = ContextualError(err, "json.Unmarshal %s", path)
+			return
+		}
+		mem.state = &state
+	})
+	if err != nil {
+		return nil, err
+	}
+	if lineErr != nil {
+		return nil, lineErr
+	}
+	return &FileConfigStore{MemoryConfigStore: mem, path: path}, nil
+}
+
+// SaveHookState replaces the file, so a crash leaves either the old or the new state
+func (f *FileConfigStore) SaveHookState(ctx context.Context, state *HookState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := rewriteJsonLines(f.path, func(enc *json.Encoder) error {
+		if err := enc.Encode(state); err != nil {
+			return ContextualError(err, "json.Encode")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.state = state
+	return nil
+}
@@ -0,0 +1,177 @@
+package eml
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a message which failed too many times to keep retrying
+type DeadLetter struct {
+	Message  *Message  `json:"message"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+// DeadLetterStore holds dead letters by message ID until they are retried or discarded
+type DeadLetterStore interface {
+	// Put replaces any dead letter for the same message
+	Put(ctx context.Context, d *DeadLetter) error
+	// List returns dead letters oldest first
+	List(ctx context.Context) ([]*DeadLetter, error)
+	Remove(ctx context.Context, messageId string) error
+}
+
+// RetryDeadLetters sends dead letters through h, all of them when no message IDs are given. Dead letters which
+// succeed are removed, those which fail again stay with their attempts and error updated.
+func RetryDeadLetters(ctx context.Context, store DeadLetterStore, h TransactionHandler, messageIds ...string) (retried int, err error) {
+	letters, err := store.List(ctx)
+	if err != nil {
+		return 0, ContextualError(err, "store.List")
+	}
+	failed := 0
+	var lastErr error
+	for _, d := range letters {
+		if len(messageIds) > 0 && !containsString(messageIds, d.Message.Id) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return retried, err
+		}
+		if err := h(ctx, d.Message); err != nil {
+			failed++
+			lastErr = err
+			retry := *d
+			retry.Attempts++
+			retry.Error = err.Error()
+			retry.Time = time.Now()
+			if err := store.Put(ctx, &retry); err != nil {
+				return retried, ContextualError(err, "store.Put %s", d.Message.Id)
+			}
+			continue
+		}
+		if err := store.Remove(ctx, d.Message.Id); err != nil {
+			return retried, ContextualError(err, "store.Remove %s", d.Message.Id)
+		}
+		retried++
+	}
+	if failed > 0 {
+		return retried, ContextualError(lastErr, "%d dead letters failed again", failed)
+	}
+	return retried, nil
+}
+
+// MemoryDeadLetterStore keeps dead letters for the life of the process
+type MemoryDeadLetterStore struct {
+	mu      sync.RWMutex
+	letters map[string]*DeadLetter
+}
+
+func NewMemoryDeadLetterStore() *MemoryDeadLetterStore {
+	return &MemoryDeadLetterStore{letters: map[string]*DeadLetter{}}
+}
+
+func (m *MemoryDeadLetterStore) Put(_ context.Context, d *DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.letters[d.Message.Id] = d
+	return nil
+}
+
+func (m *MemoryDeadLetterStore) List(context.Context) ([]*DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sorted(), nil
+}
+
+func (m *MemoryDeadLetterStore) Remove(_ context.Context, messageId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.letters, messageId)
+	return nil
+}
+
+// Must hold the lock
+func (m *MemoryDeadLetterStore) sorted() []*DeadLetter {
+	letters := make([]*DeadLetter, 0, len(m.letters))
+	for _, d := range m.letters {
+		letters = append(letters, d)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Time.Before(letters[j].Time) })
+	return letters
+}
+
+// FileDeadLetterStore keeps dead letters in memory and logs changes to a file so they survive restarts
+type FileDeadLetterStore struct {
+	*MemoryDeadLetterStore
+	// Held across the memory and file updates so records are written in the order they happen
+	mu   sync.Mutex
+	file *jsonLinesFile
+}
+
+type deadLetterRecord struct {
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty"`
+	// Set when the dead letter for this message was removed
+	Removed string `json:"removed,omitempty"`
+}
+
+// NewFileDeadLetterStore loads dead letters from path, compacting the file
+func NewFileDeadLetterStore(path string) (*FileDeadLetterStore, error) {
+	mem := NewMemoryDeadLetterStore()
+	err := readJsonLines(path, func(line []byte) {
+		var r deadLetterRecord
+		// Skip a torn final line from a crash
+		if err := json.Unmarshal(line, &r); err != nil {
+			return
+		}
+		if r.DeadLetter != nil && r.DeadLetter.Message != nil {
+			mem.letters[r.DeadLetter.Message.Id] = r.DeadLetter
+		} else if r.Removed != "" {
+			delete(mem.letters, r.Removed)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = rewriteJsonLines(path, func(enc *json.Encoder) error {
+		for _, d := range mem.sorted() {
+			if err := enc.Encode(deadLetterRecord{DeadLetter: d}); err != nil {
+				return ContextualError(err, "json.Encode")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f, err := openJsonLines(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterStore{MemoryDeadLetterStore: mem, file: f}, nil
+}
+
+func (f *FileDeadLetterStore) Put(ctx context.Context, d *DeadLetter) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.MemoryDeadLetterStore.Put(ctx, d); err != nil {
+		return err
+	}
+	return f.file.append(deadLetterRecord{DeadLetter: d}, true)
+}
+
+func (f *FileDeadLetterStore) Remove(ctx context.Context, messageId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.MemoryDeadLetterStore.Remove(ctx, messageId); err != nil {
+		return err
+	}
+	return f.file.append(deadLetterRecord{Removed: messageId}, false)
+}
+
+func (f *FileDeadLetterStore) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,130 @@
+package eml
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MessageDecoder maps one version of a payload into Message, the model handlers see whatever version EML sent
+type MessageDecoder func(body []byte) (*Message, error)
+
+// UnknownVersionPolicy decides what happens to a message version with no registered decoder
+type UnknownVersionPolicy int
+
+const (
+	// Fail with 501 Not Implemented so EML keeps the message as undeliverable
+	RejectUnknownVersion UnknownVersionPolicy = iota
+	// Archive the message, if there is an archive, and acknowledge it without handling it
+	AcknowledgeUnknownVersion
+	// Decode with the decoder for the newest registered version of the type
+	BestEffortUnknownVersion
+)
+
+func (p UnknownVersionPolicy) String() string {
+	switch p {
+	case RejectUnknownVersion:
+		return "reject"
+	case AcknowledgeUnknownVersion:
+		return "acknowledge"
+	case BestEffortUnknownVersion:
+		return "best_effort"
+	}
+	return "unknown"
+}
+
+// DecodeMessageV1 decodes version 1 of transaction, undeliverable_alert and ping messages
+func DecodeMessageV1(body []byte) (*Message, error) {
+	var message Message
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, ContextualError(err, "json.Unmarshal")
+	}
+	return &message, nil
+}
+
+// DecoderRegistry holds decoders by message type and version. A version is registered either exactly, e.g.
+// "2.1.0", or by major version, e.g. "2", which matches any 2.x the exact versions don't.
+type DecoderRegistry struct {
+	mu       sync.RWMutex
+	decoders map[TransactionType]map[string]MessageDecoder
+	policy   UnknownVersionPolicy
+}
+
+func NewDecoderRegistry(policy UnknownVersionPolicy) *DecoderRegistry {
+	return &DecoderRegistry{decoders: map[TransactionType]map[string]MessageDecoder{}, policy: policy}
+}
+
+// DefaultDecoderRegistry decodes version 1 of the message types EML sends
+func DefaultDecoderRegistry(policy UnknownVersionPolicy) *DecoderRegistry {
+	r := NewDecoderRegistry(policy)
+	r.Register(TxnTypeTransaction, "1", DecodeMessageV1)
+	r.Register(TxnTypeUndeliverableAlert, "1", DecodeMessageV1)
+	r.Register(TxnTypePing, "1", DecodeMessageV1)
+	return r
+}
+
+var defaultDecoders = DefaultDecoderRegistry(RejectUnknownVersion)
+
+func (r *DecoderRegistry) Register(messageType TransactionType, version string, d MessageDecoder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions, ok := r.decoders[messageType]
+	if !ok {
+		versions = map[string]MessageDecoder{}
+		r.decoders[messageType] = versions
+	}
+	versions[version] = d
+}
+
+func (r *DecoderRegistry) Policy() UnknownVersionPolicy {
+	return r.policy
+}
+
+// Decoder finds the decoder for a message, nil when the version is unknown and the policy isn't best effort.
+// Types with no decoders at all are decoded as version 1, so handlers can be added for types we don't model.
+func (r *DecoderRegistry) Decoder(messageType TransactionType, version string) MessageDecoder {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	versions, ok := r.decoders[messageType]
+	if !ok {
+		return DecodeMessageV1
+	}
+	if d, ok := versions[version]; ok {
+		return d
+	}
+	if d, ok := versions[strings.SplitN(version, ".", 2)[0]]; ok {
+		return d
+	}
+	if r.policy != BestEffortUnknownVersion {
+		return nil
+	}
+	var latest string
+	for v := range versions {
+		if latest == "" || compareVersions(v, latest) > 0 {
+			latest = v
+		}
+	}
+	return versions[latest]
+}
+
+// Compares dotted versions numerically, missing parts count as zero
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
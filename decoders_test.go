@@ -0,0 +1,67 @@
+package eml
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecoderRegistry_Decoder(t *testing.T) {
+	v2 := func(body []byte) (*Message, error) { return &Message{Id: "v2"}, nil }
+	v21 := func(body []byte) (*Message, error) { return &Message{Id: "v2.1"}, nil }
+	r := DefaultDecoderRegistry(RejectUnknownVersion)
+	r.Register(TxnTypeTransaction, "2", v2)
+	r.Register(TxnTypeTransaction, "2.1.0", v21)
+	decodedId := func(d MessageDecoder) string {
+		m, _ := d([]byte(`{"id":"v1"}`))
+		return m.Id
+	}
+
+	assert.Equal(t, "v1", decodedId(r.Decoder(TxnTypeTransaction, "1.0.0")))
+	assert.Equal(t, "v2", decodedId(r.Decoder(TxnTypeTransaction, "2.0.3")))
+	assert.Equal(t, "v2.1", decodedId(r.Decoder(TxnTypeTransaction, "2.1.0")))
+	assert.Nil(t, r.Decoder(TxnTypeTransaction, "3.0.0"))
+	assert.Equal(t, "v1", decodedId(r.Decoder("card_event", "7.0.0")), "types we don't model are decoded as version 1")
+
+	r = DefaultDecoderRegistry(BestEffortUnknownVersion)
+	r.Register(TxnTypeTransaction, "2", v2)
+	r.Register(TxnTypeTransaction, "10", v21)
+	assert.Equal(t, "v2.1", decodedId(r.Decoder(TxnTypeTransaction, "11.0.0")), "best effort uses the newest decoder")
+}
+
+func TestNewWebhookHandler_unknownVersion(t *testing.T) {
+	archive, err := NewFileArchive(filepath.Join(t.TempDir(), "archive.jsonl"))
+	assert.NoError(t, err)
+	defer archive.Close()
+	var handled []string
+	deps := &Dependencies{Config: &Config{NotificationHookId: "hook1", HmacKey: testHmacKey}, Archive: archive}
+	handler := NewWebhookHandler(deps, WithTransactionHandler(func(ctx context.Context, m *Message) error {
+		handled = append(handled, m.Id)
+		return nil
+	}))
+	client := NewWebhookTestClient(testHmacKey, "http://localhost/eml")
+	body, _ := json.Marshal(testTxnMessage())
+	send := func() int {
+		req, _ := client.NewRawRequest(ctx, "transaction@2.0.0", body)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNotImplemented, send(), "unknown versions are rejected by default")
+
+	deps.Decoders = DefaultDecoderRegistry(AcknowledgeUnknownVersion)
+	assert.Equal(t, http.StatusOK, send())
+	archived, _ := archive.Find(ctx, ArchiveFilter{})
+	assert.Len(t, archived, 1)
+	assert.Equal(t, "m1", archived[0].MessageId)
+	assert.Empty(t, handled)
+
+	deps.Decoders = DefaultDecoderRegistry(BestEffortUnknownVersion)
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, []string{"m1"}, handled)
+}
@@ -0,0 +1,185 @@
+package eml
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Claims not completed within this time are assumed abandoned, e.g. by a crashed process
+const defaultDedupClaimTimeout = 5 * time.Minute
+
+type DedupState int
+
+const (
+	DedupNew DedupState = iota
+	DedupInProgress
+	DedupDone
+)
+
+// DedupStore tracks which message IDs have been processed
+type DedupStore interface {
+	// Claim returns DedupNew and claims the ID if it hasn't been seen, otherwise its current state
+	Claim(ctx context.Context, id string) (DedupState, error)
+	// Complete marks a claimed ID as processed
+	Complete(ctx context.Context, id string) error
+	// Release drops a claim so a redelivery can be processed
+	Release(ctx context.Context, id string) error
+}
+
+const ErrorDuplicateInProgress sUserErrorMessage = "Message is already being processed"
+
+// Deduplicate wraps h so each message ID is processed once, later deliveries of a processed message are acknowledged
+// and deliveries while it is still being processed fail with 409 Conflict so EML tries again.
+func Deduplicate(store DedupStore, h TransactionHandler) TransactionHandler {
+	return func(ctx context.Context, message *Message) error {
+		if message.Id == "" {
+			return h(ctx, message)
+		}
+		state, err := store.Claim(ctx, message.Id)
+		if err != nil {
+			return ContextualError(err, "store.Claim")
+		}
+		switch state {
+		case DedupDone:
+			return nil
+		case DedupInProgress:
+			return NewHttpError(http.StatusConflict, ErrorDuplicateInProgress, fmt.Errorf("message %s is being processed", message.Id))
+		}
+		if err := h(ctx, message); err != nil {
+			if releaseErr := store.Release(ctx, message.Id); releaseErr != nil {
+				return ContextualError(err, "store.Release failed (%v)", releaseErr)
+			}
+			return err
+		}
+		if err := store.Complete(ctx, message.Id); err != nil {
+			return ContextualError(err, "store.Complete")
+		}
+		return nil
+	}
+}
+
+type dedupEntry struct {
+	state   DedupState
+	expires time.Time
+}
+
+// MemoryDedupStore remembers processed IDs for a TTL
+type MemoryDedupStore struct {
+	mu        sync.Mutex
+	entries   map[string]dedupEntry
+	ttl       time.Duration
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryDedupStore(ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{entries: map[string]dedupEntry{}, ttl: ttl, now: time.Now}
+}
+
+func (m *MemoryDedupStore) Claim(_ context.Context, id string) (DedupState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.sweep(now)
+	if e, ok := m.entries[id]; ok && e.expires.After(now) {
+		return e.state, nil
+	}
+	m.entries[id] = dedupEntry{state: DedupInProgress, expires: now.Add(defaultDedupClaimTimeout)}
+	return DedupNew, nil
+}
+
+func (m *MemoryDedupStore) Complete(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[id] = dedupEntry{state: DedupDone, expires: m.now().Add(m.ttl)}
+	return nil
+}
+
+func (m *MemoryDedupStore) Release(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, id)
+	return nil
+}
+
+func (m *MemoryDedupStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// Drops expired entries at most once per minute, must hold the lock
+func (m *MemoryDedupStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for id, e := range m.entries {
+		if !e.expires.After(now) {
+			delete(m.entries, id)
+		}
+	}
+}
+
+// FileDedupStore keeps processed IDs in memory and appends them to a file so they survive restarts.
+// Claims are held in memory only.
+type FileDedupStore struct {
+	*MemoryDedupStore
+	file *jsonLinesFile
+}
+
+type dedupRecord struct {
+	Id      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewFileDedupStore loads unexpired IDs from path, compacting the file
+func NewFileDedupStore(path string, ttl time.Duration) (*FileDedupStore, error) {
+	mem := NewMemoryDedupStore(ttl)
+	now := mem.now()
+	err := readJsonLines(path, func(line []byte) {
+		var r dedupRecord
+		// Skip a torn final line from a crash
+		if err := json.Unmarshal(line, &r); err != nil || r.Id == "" {
+			return
+		}
+		if r.Expires.After(now) {
+			mem.entries[r.Id] = dedupEntry{state: DedupDone, expires: r.Expires}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = rewriteJsonLines(path, func(enc *json.Encoder) error {
+		for id, e := range mem.entries {
+			if err := enc.Encode(dedupRecord{Id: id, Expires: e.expires}); err != nil {
+				return ContextualError(err, "json.Encode")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f, err := openJsonLines(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDedupStore{MemoryDedupStore: mem, file: f}, nil
+}
+
+func (f *FileDedupStore) Complete(ctx context.Context, id string) error {
+	if err := f.MemoryDedupStore.Complete(ctx, id); err != nil {
+		return err
+	}
+	// Synced as the message is acknowledged next, losing the record would mean processing it again
+	return f.file.append(dedupRecord{Id: id, Expires: f.now().Add(f.ttl)}, true)
+}
+
+func (f *FileDedupStore) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,73 @@
+package eml
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicate(t *testing.T) {
+	store := NewMemoryDedupStore(time.Hour)
+	calls := 0
+	fail := true
+	h := Deduplicate(store, func(ctx context.Context, m *Message) error {
+		calls++
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	m := &Message{Id: "m1"}
+
+	assert.Error(t, h(ctx, m))
+	fail = false
+	assert.NoError(t, h(ctx, m), "failed messages can be redelivered")
+	assert.NoError(t, h(ctx, m), "duplicates are acknowledged")
+	assert.Equal(t, 2, calls)
+
+	state, err := store.Claim(ctx, "m2")
+	assert.NoError(t, err)
+	assert.Equal(t, DedupNew, state)
+	err = h(ctx, &Message{Id: "m2"})
+	assert.Equal(t, http.StatusConflict, errorStatus(err), "in progress duplicates should be retried later")
+	assert.Equal(t, 2, calls)
+}
+
+func TestMemoryDedupStore_ttl(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryDedupStore(time.Hour)
+	store.now = func() time.Time { return now }
+
+	_, _ = store.Claim(ctx, "m1")
+	assert.NoError(t, store.Complete(ctx, "m1"))
+	state, _ := store.Claim(ctx, "m1")
+	assert.Equal(t, DedupDone, state)
+
+	now = now.Add(2 * time.Hour)
+	state, _ = store.Claim(ctx, "m1")
+	assert.Equal(t, DedupNew, state, "expired IDs are forgotten")
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestFileDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.jsonl")
+	store, err := NewFileDedupStore(path, time.Hour)
+	assert.NoError(t, err)
+	_, _ = store.Claim(ctx, "m1")
+	assert.NoError(t, store.Complete(ctx, "m1"))
+	_, _ = store.Claim(ctx, "m2")
+	assert.NoError(t, store.Close())
+
+	reopened, err := NewFileDedupStore(path, time.Hour)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	state, _ := reopened.Claim(ctx, "m1")
+	assert.Equal(t, DedupDone, state, "completed IDs survive a restart")
+	state, _ = reopened.Claim(ctx, "m2")
+	assert.Equal(t, DedupNew, state, "claims don't survive a restart")
+}
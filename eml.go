@@ -7,7 +7,21 @@ type EML struct {
 type Dependencies struct {
 	Config *Config
 	Store  Store
-	//Data      data.Store
+	Logger Logger
+	// Masks sensitive fields in logs, DefaultRedactor when nil
+	Redactor *Redactor
+	Metrics  MetricsRecorder
+	Tracing  *TraceHooks
+	// Stores each verified webhook when set
+	Archive Archive
+	// Decodes webhook payloads, DefaultDecoderRegistry rejecting unknown versions when nil
+	Decoders *DecoderRegistry
+	// Rejects stale and replayed webhooks when set
+	ReplayProtection *ReplayProtection
+	// Tunes processing of undeliverable messages, defaults when nil
+	Undeliverable *UndeliverableOptions
+	// Where Dependencies.SetupHook saves the hook ID and key, webhooks load them from here while Config has no hook ID
+	Data ConfigStore
 	//Users     users.Store
 	//Secrets   secrets.Store
 	//Messaging messages.Service
@@ -16,6 +30,34 @@ type Dependencies struct {
 	//Env       *env.Settings
 }
 
+func (d *Dependencies) logger() Logger {
+	if d == nil {
+		return nopLogger{}
+	}
+	return NewRedactingLogger(loggerOrNop(d.Logger), d.Redactor)
+}
+
+func (d *Dependencies) metrics() MetricsRecorder {
+	if d == nil {
+		return nopMetrics{}
+	}
+	return metricsOrNop(d.Metrics)
+}
+
+func (d *Dependencies) tracing() *TraceHooks {
+	if d == nil {
+		return nil
+	}
+	return d.Tracing
+}
+
+func (d *Dependencies) decoders() *DecoderRegistry {
+	if d == nil || d.Decoders == nil {
+		return defaultDecoders
+	}
+	return d.Decoders
+}
+
 func New(d *Dependencies) *EML {
 	return &EML{
 		d,
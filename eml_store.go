@@ -2,7 +2,6 @@ package eml
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"strconv"
 	"sync"
@@ -37,12 +36,41 @@ type Store interface {
 	Activate(ctx context.Context, eaid string, req ActivateRequest) error
 }
 
+// HookUpdater is implemented by stores which can change any field of a hook, stores without it only have their
+// hook's scope reconciled
+type HookUpdater interface {
+	UpdateHook(ctx context.Context, hookId string, request *HookRequest) error
+}
+
 type Settings struct {
 	FunctionHost string
 	HookUri      string
 	EmlRestId    string
 	EmlHostUrl   string
 	DebugRest    bool
+	Logger       Logger
+	// Masks sensitive fields in logs and DebugRest output, DefaultRedactor when nil
+	Redactor *Redactor
+	Metrics  MetricsRecorder
+	Tracing  *TraceHooks
+	// Receives a record of every call which changes account or card state
+	Audit AuditSink
+	// Tunes processing of undeliverable messages, defaults when nil
+	Undeliverable *UndeliverableOptions
+}
+
+func (s *Settings) logger() Logger {
+	if s == nil {
+		return nopLogger{}
+	}
+	return NewRedactingLogger(loggerOrNop(s.Logger), s.Redactor)
+}
+
+func (s *Settings) metrics() MetricsRecorder {
+	if s == nil {
+		return nopMetrics{}
+	}
+	return metricsOrNop(s.Metrics)
 }
 
 type emlStore struct {
@@ -62,61 +90,84 @@ func (e *emlStore) lazyInit(ctx context.Context) {
 			SetHeader(headerAccept, contentTypeEmlJson).
 			SetError(&ErrorModel{}).
 			SetDebug(e._env.DebugRest).
+			SetLogger(restyLogger{e.log()}).
 			OnBeforeRequest(e.onBeforeRequest).
-			OnBeforeRequest(logRequest).
-			OnAfterResponse(logResponse)
+			OnBeforeRequest(e.startRequest).
+			OnBeforeRequest(e.logRequest).
+			OnAfterResponse(e.logResponse).
+			OnRequestLog(e.redactRequestLog).
+			OnResponseLog(e.redactResponseLog)
 	})
 }
 
+func (e *emlStore) log() Logger {
+	return e._env.logger()
+}
+
+func (e *emlStore) metrics() MetricsRecorder {
+	return e._env.metrics()
+}
+
+func (e *emlStore) tracing() *TraceHooks {
+	if e._env == nil {
+		return nil
+	}
+	return e._env.Tracing
+}
+
 func (e *emlStore) request(ctx context.Context) *resty.Request {
 	e.lazyInit(ctx)
 	return e._lazyClient.R().SetContext(ctx)
 }
 
+// Request for a path with an {id} param, the ID is kept for tracing as resty doesn't expose path params
+func (e *emlStore) requestWithId(ctx context.Context, id string) *resty.Request {
+	return e.request(context.WithValue(ctx, pathIdKey{}, id)).
+		SetPathParams(map[string]string{"id": id})
+}
+
 func (e *emlStore) CreateAccount(ctx context.Context, account *CreateAccountRequest) (*AccountSummary, error) {
-	log.Printf("Creating EML account in company %s with load %s from %s", account.CompanyId, account.InitialLoadAmount, account.CorrespondingAccountId)
+	e.log().Info("Creating EML account", KV("company", account.CompanyId), KV("load", account.InitialLoadAmount), KV("from", account.CorrespondingAccountId))
 	resp, err := e.request(ctx).
 		SetBody(account).
 		SetResult(&AccountSummary{}).
 		SetHeader(headerContentType, contentTypeEmlJson).
 		Post("/3.0/accounts")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return nil, err
 	}
 	return resp.Result().(*AccountSummary), nil
 }
 
 func (e *emlStore) GetAccount(ctx context.Context, eaid string, flags ...GetAccountFlag) (*AccountInfo, error) {
-	log.Printf("Getting account %s with flags %v", eaid, flags)
+	e.log().Info("Getting account", KV("eaid", eaid), KV("flags", flags))
 	queryParams := make(map[string]string)
 	for _, flag := range flags {
 		queryParams[string(flag)] = "1"
 	}
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
+	resp, err := e.requestWithId(ctx, eaid).
 		SetQueryParams(queryParams).
 		SetResult(&AccountInfo{}).
 		Get("/3.0/accounts/{id}")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return nil, err
 	}
 	return resp.Result().(*AccountInfo), nil
 }
 
 func (e *emlStore) GetSummary(ctx context.Context, eaid string) (*AccountSummary, error) {
-	log.Printf("Getting account %s summary", eaid)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
+	e.log().Info("Getting account summary", KV("eaid", eaid))
+	resp, err := e.requestWithId(ctx, eaid).
 		SetResult(&AccountSummary{}).
 		Get("/3.0/accounts/{id}/status")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return nil, err
 	}
 	return resp.Result().(*AccountSummary), nil
 }
 
 func (e *emlStore) GetTransactions(ctx context.Context, eaid string, pageSize int, cursor string, startDate *time.Time, endDate *time.Time) (*TransactionsPage, error) {
-	log.Printf("Getting account %s transactions (%d, %s)", eaid, pageSize, cursor)
+	e.log().Info("Getting account transactions", KV("eaid", eaid), KV("pageSize", pageSize), KV("cursor", cursor))
 	pageNumber := cursor
 	if pageNumber == "" {
 		pageNumber = "1"
@@ -132,8 +183,7 @@ func (e *emlStore) GetTransactions(ctx context.Context, eaid string, pageSize in
 		endDateStr = endDate.Format(df)
 	}
 
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
+	resp, err := e.requestWithId(ctx, eaid).
 		SetQueryParams(map[string]string{
 			queryPageNumber: pageNumber,
 			queryPageSize:   strconv.Itoa(pageSize),
@@ -142,7 +192,7 @@ func (e *emlStore) GetTransactions(ctx context.Context, eaid string, pageSize in
 		}).
 		SetResult([]Transaction{}).
 		Get("/3.0/accounts/{id}/transactions")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return nil, err
 	}
 	actualPageSize, _ := strconv.Atoi(resp.Header().Get(headerPageSize))
@@ -172,96 +222,98 @@ func (e *emlStore) GetTransactions(ctx context.Context, eaid string, pageSize in
 }
 
 func (e *emlStore) UpdateStatus(ctx context.Context, eaid string, status CardStatus) error {
-	log.Printf("Updating account %s status %s", eaid, status)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
+	e.log().Info("Updating account status", KV("eaid", eaid), KV("status", status))
+	resp, err := e.requestWithId(ctx, eaid).
 		SetBody(StatusRequest{Status: status}).
 		SetHeader(headerContentType, contentTypeEmlJson).
 		Put("/3.0/accounts/{id}/status")
-	if err := checkError(resp, err); err != nil {
-		return err
-	}
-	return nil
+	err = e.checkError(resp, err)
+	e.audit(ctx, &AuditRecord{Operation: AuditUpdateStatus, Eaid: eaid, After: status}, err)
+	return err
 }
 
 func (e *emlStore) UpdatePlasticEnabled(ctx context.Context, eaid string, enabled bool) error {
-	log.Printf("Updating account %s isPlasticEnabled %v", eaid, enabled)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
+	e.log().Info("Updating account plastic enabled", KV("eaid", eaid), KV("enabled", enabled))
+	resp, err := e.requestWithId(ctx, eaid).
 		SetBody(PlasticEnabledRequest{PlasticEnabled: enabled}).
 		SetHeader(headerContentType, contentTypeEmlJson).
 		Put("/3.0/accounts/{id}/plastic")
-	if err := checkError(resp, err); err != nil {
-		return err
-	}
-	return nil
+	err = e.checkError(resp, err)
+	e.audit(ctx, &AuditRecord{Operation: AuditUpdatePlasticEnabled, Eaid: eaid, After: enabled}, err)
+	return err
 }
 
 func (e *emlStore) UpdateRegistration(ctx context.Context, eaid string, info RegistrationInfo) error {
-	log.Printf("Updating account %s registration %s %s\n", eaid, info.Email(), info.Phone())
+	e.log().Info("Updating account registration", KV("eaid", eaid), KV("email", info.Email()), KV("phone", info.Phone()))
+	// The actor comes from WithActor, info is the cardholder being updated
+	record := &AuditRecord{Operation: AuditUpdateRegistration, Eaid: eaid}
 	account, err := e.GetAccount(ctx, eaid, WithPersonal)
 	if err != nil {
-		return ContextualError(err, "e.GetAccount")
+		err = ContextualError(err, "e.GetAccount")
+		e.audit(ctx, record, err)
+		return err
 	}
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
-		SetBody(mapRegistrationUpdate(account, info)).
+	var before Registration
+	if account.Personal != nil {
+		// mapRegistrationUpdate modifies the fetched registration
+		before = *account.Personal
+	}
+	update := mapRegistrationUpdate(account, info)
+	record.After = auditRegistration{Changed: changedRegistrationFields(&before, update.Registration)}
+	resp, err := e.requestWithId(ctx, eaid).
+		SetBody(update).
 		SetHeader(headerContentType, contentTypeEmlJson).
 		Put("/3.0/accounts/{id}")
-	if err := checkError(resp, err); err != nil {
-		return err
-	}
-	return nil
+	err = e.checkError(resp, err)
+	e.audit(ctx, record, err)
+	return err
 }
 
 func (e *emlStore) UpdateFreeFields(ctx context.Context, eaid string, fields *freeFieldsRequest) error {
-	log.Printf("Updating account %s free fields %v\n", eaid, *fields)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
+	e.log().Info("Updating account free fields", KV("eaid", eaid), KV("fields", *fields))
+	resp, err := e.requestWithId(ctx, eaid).
 		SetBody(fields).
 		SetHeader(headerContentType, contentTypeEmlJson).
 		Put("/3.0/accounts/{id}/freefields")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (e *emlStore) Transfer(ctx context.Context, eaid string, request *TransferRequest) error {
-	log.Printf("Performing account %s transfer %s to %s", eaid, request.Amount, request.DestinationAccountId)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
+	e.log().Info("Performing account transfer", KV("eaid", eaid), KV("amount", request.Amount), KV("to", request.DestinationAccountId))
+	resp, err := e.requestWithId(ctx, eaid).
 		SetBody(request).
 		SetHeader(headerContentType, contentTypeEmlJson).
 		Post("/3.0/accounts/{id}/transfer")
-	if err := checkError(resp, err); err != nil {
-		return err
-	}
-	return nil
+	err = e.checkError(resp, err)
+	e.audit(ctx, &AuditRecord{Operation: AuditTransfer, Eaid: eaid, Actor: request.Username, After: request, RequestId: request.RequestId}, err)
+	return err
 }
 
 func (e *emlStore) AddHook(ctx context.Context, request *HookRequest) (string, error) {
-	log.Println("Adding notifications webhook", request.Uri, "scope", request.Scope)
+	e.log().Info("Adding notifications webhook", KV("uri", request.Uri), KV("scope", request.Scope))
 	resp, err := e.request(ctx).
 		SetBody(request).
 		SetResult(&IdModel{}).
 		SetHeader(headerContentType, contentTypeJson).
 		SetHeader(headerAccept, contentTypeJson).
 		Post("/3.0/hooks")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return "", err
 	}
 	return resp.Result().(*IdModel).Id, nil
 }
 
 func (e *emlStore) GetHooks(ctx context.Context) (*HookPage, error) {
-	log.Println("Getting notification webhooks")
+	e.log().Info("Getting notification webhooks")
 	hooks := &[]Hook{}
 	resp, err := e.request(ctx).
 		SetResult(hooks).
 		SetHeader(headerAccept, contentTypeJson).
 		Get("/3.0/hooks")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return nil, err
 	}
 	actualPageSize, _ := strconv.Atoi(resp.Header().Get(headerPageSize))
@@ -276,53 +328,62 @@ func (e *emlStore) GetHooks(ctx context.Context) (*HookPage, error) {
 }
 
 func (e *emlStore) GetHook(ctx context.Context, hookId string) (*Hook, error) {
-	log.Println("Getting notification webhook", hookId)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": hookId}).
+	e.log().Info("Getting notification webhook", KV("hookId", hookId))
+	resp, err := e.requestWithId(ctx, hookId).
 		SetResult(&Hook{}).
 		SetHeader(headerAccept, contentTypeJson).
 		Get("/3.0/hooks/{id}")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return nil, err
 	}
 	return resp.Result().(*Hook), nil
 }
 
 func (e *emlStore) DeleteHook(ctx context.Context, hookId string) error {
-	log.Println("Deleting notification webhook", hookId)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": hookId}).
+	e.log().Info("Deleting notification webhook", KV("hookId", hookId))
+	resp, err := e.requestWithId(ctx, hookId).
 		SetHeader(headerAccept, contentTypeJson).
 		Delete("/3.0/hooks/{id}")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (e *emlStore) UpdateHookScope(ctx context.Context, hookId string, scope []int) error {
-	log.Println("Updating notification webhook", hookId, "scope", scope)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": hookId}).
+	e.log().Info("Updating notification webhook scope", KV("hookId", hookId), KV("scope", scope))
+	resp, err := e.requestWithId(ctx, hookId).
 		SetBody(HookRequest{Scope: scope}).
 		SetHeader(headerContentType, contentTypeJson).
 		SetHeader(headerAccept, contentTypeJson).
 		Patch("/3.0/hooks/{id}")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (e *emlStore) UpdateHook(ctx context.Context, hookId string, request *HookRequest) error {
+	e.log().Info("Updating notification webhook", KV("hookId", hookId), KV("uri", request.Uri), KV("scope", request.Scope))
+	resp, err := e.requestWithId(ctx, hookId).
+		SetBody(request).
+		SetHeader(headerContentType, contentTypeJson).
+		SetHeader(headerAccept, contentTypeJson).
+		Patch("/3.0/hooks/{id}")
+	if err := e.checkError(resp, err); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (e *emlStore) GetUndeliverable(ctx context.Context, hookId string, pageSize int, pageNumber int) (*MessagePage, error) {
-	log.Println("Getting notification webhook", hookId, "undeliverable messages")
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": hookId}).
+	e.log().Info("Getting notification webhook undeliverable messages", KV("hookId", hookId), KV("pageNumber", pageNumber))
+	resp, err := e.requestWithId(ctx, hookId).
 		SetQueryParams(map[string]string{queryPageNumber: strconv.Itoa(pageNumber), queryPageSize: strconv.Itoa(pageSize)}).
 		SetResult([]Message{}).
 		SetHeader(headerAccept, contentTypeJson).
 		Get("/3.0/hooks/{id}/undeliverable")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return nil, err
 	}
 	actualPageSize, _ := strconv.Atoi(resp.Header().Get(headerPageSize))
@@ -338,56 +399,52 @@ func (e *emlStore) GetUndeliverable(ctx context.Context, hookId string, pageSize
 }
 
 func (e *emlStore) DismissUndeliverable(ctx context.Context, hookId string, messageIds []string) error {
-	log.Println("Dismissing notification webhook", hookId, "messages", messageIds)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": hookId}).
+	e.log().Info("Dismissing notification webhook messages", KV("hookId", hookId), KV("messageIds", messageIds))
+	resp, err := e.requestWithId(ctx, hookId).
 		SetBody(&MessageIdsRequest{MessageIds: messageIds}).
 		SetHeader(headerContentType, contentTypeJson).
 		SetHeader(headerAccept, contentTypeJson).
 		Post("/3.0/hooks/{id}/undeliverable/dismiss")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (e *emlStore) Authenticate(ctx context.Context, eaid string, req AuthenticateRequest) (*AuthenticateResponse, error) {
-	log.Printf("Authenticating account %s from IP %s", eaid, req.IPAddress)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
+	e.log().Info("Authenticating account", KV("eaid", eaid), KV("ip", req.IPAddress))
+	resp, err := e.requestWithId(ctx, eaid).
 		SetBody(req).
 		SetResult(&AuthenticateResponse{}).
 		SetHeader(headerContentType, contentTypeEmlJson).
 		Post("/3.0/accounts/{id}/authenticate")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return nil, err
 	}
 	return resp.Result().(*AuthenticateResponse), nil
 }
 
 func (e *emlStore) Initiate(ctx context.Context, eaid string, req InitiateRequest) (*InitiateResponse, error) {
-	log.Printf("Initiating %s operation for account %s via %s", req.OperationType, eaid, req.CommunicationMethod)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
+	e.log().Info("Initiating account operation", KV("eaid", eaid), KV("operation", req.OperationType), KV("via", req.CommunicationMethod))
+	resp, err := e.requestWithId(ctx, eaid).
 		SetBody(req).
 		SetResult(&InitiateResponse{}).
 		SetHeader(headerContentType, contentTypeEmlJson).
 		Post("/3.0/accounts/{id}/initiate")
-	if err := checkError(resp, err); err != nil {
+	if err := e.checkError(resp, err); err != nil {
 		return nil, err
 	}
 	return resp.Result().(*InitiateResponse), nil
 }
 
 func (e *emlStore) Activate(ctx context.Context, eaid string, req ActivateRequest) error {
-	log.Printf("Activating operation %s for account %s", req.ValidationData.OperationID, eaid)
-	resp, err := e.request(ctx).
-		SetPathParams(map[string]string{"id": eaid}).
+	e.log().Info("Activating account operation", KV("eaid", eaid), KV("operationId", req.ValidationData.OperationID))
+	resp, err := e.requestWithId(ctx, eaid).
 		SetBody(req).
 		SetHeader(headerContentType, contentTypeEmlJson).
 		Post("/3.0/accounts/{id}/activate")
-	if err := checkError(resp, err); err != nil {
-		return err
-	}
-	return nil
+	err = e.checkError(resp, err)
+	after := &auditActivation{OperationId: req.ValidationData.OperationID, IPAddress: req.ValidationData.IPAddress, EnablePlastic: req.EnablePlastic}
+	e.audit(ctx, &AuditRecord{Operation: AuditActivate, Eaid: eaid, After: after}, err)
+	return err
 }
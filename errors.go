@@ -12,6 +12,10 @@ const (
 	ErrorNotImplemented    sUserErrorMessage = "This operation is currently not supported"
 	ErrorValidation        sUserErrorMessage = "Input data has failed validation"
 	ErrorParsingBody       sUserErrorMessage = "Error parsing body"
+	ErrorMethodNotAllowed  sUserErrorMessage = "Method not allowed"
+	ErrorBodyTooLarge      sUserErrorMessage = "Request body is too large"
+	ErrorUnsupportedType   sUserErrorMessage = "Request body must be JSON"
+	ErrorInvalidSignature  sUserErrorMessage = "Message signature is not valid"
 )
 
 const (
@@ -61,6 +65,17 @@ func IsNotFoundError(err error) bool {
 	return false
 }
 
+// HTTP status for err, 200 when nil and 500 when it isn't an Error
+func errorStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	if e, ok := err.(Error); ok {
+		return e.Status()
+	}
+	return http.StatusInternalServerError
+}
+
 type httpError struct {
 	status           int
 	err              error
@@ -0,0 +1,164 @@
+package eml
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const (
+	defaultHealthTimeout       = 10 * time.Second
+	defaultMaxUndeliverableAge = time.Hour
+)
+
+const (
+	HealthCheckToken         = "token"
+	HealthCheckHook          = "hook"
+	HealthCheckUndeliverable = "undeliverable"
+)
+
+// TokenChecker is implemented by stores which can confirm an access token is obtainable
+type TokenChecker interface {
+	CheckToken(ctx context.Context) error
+}
+
+// HealthCheck verifies the EML integration can authenticate and that our webhook is set up and being delivered
+type HealthCheck struct {
+	Config   *Config
+	Store    Store
+	Settings *Settings
+	// Limit for all checks together, defaults to 10s
+	Timeout time.Duration
+	// Oldest undeliverable message tolerated before the integration is unhealthy, defaults to 1h
+	MaxUndeliverableAge time.Duration
+	// Defaults to time.Now
+	Now func() time.Time
+}
+
+type HealthReport struct {
+	Healthy   bool                `json:"healthy"`
+	CheckedAt time.Time           `json:"checked_at"`
+	Duration  string              `json:"duration"`
+	Checks    []HealthCheckResult `json:"checks"`
+}
+
+type HealthCheckResult struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	// Set when the check couldn't be run, it doesn't make the report unhealthy
+	Skipped bool   `json:"skipped,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (h *HealthCheck) Check(ctx context.Context) *HealthReport {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := h.now()
+	report := &HealthReport{Healthy: true, CheckedAt: start.UTC()}
+	add := func(name string, err error) {
+		result := HealthCheckResult{Name: name, Healthy: err == nil}
+		if err != nil {
+			result.Message = err.Error()
+			report.Healthy = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	if tc, ok := h.Store.(TokenChecker); ok {
+		add(HealthCheckToken, h.checkToken(ctx, tc))
+	} else {
+		report.Checks = append(report.Checks, HealthCheckResult{Name: HealthCheckToken, Healthy: true, Skipped: true,
+			Message: fmt.Sprintf("%T doesn't implement TokenChecker", h.Store)})
+	}
+	hook, err := h.checkHook(ctx)
+	add(HealthCheckHook, err)
+	if hook != nil {
+		add(HealthCheckUndeliverable, h.checkUndeliverable(hook))
+	} else {
+		add(HealthCheckUndeliverable, fmt.Errorf("hook not available"))
+	}
+	report.Duration = h.now().Sub(start).String()
+	return report
+}
+
+// Handle writes the report as JSON, with 503 Service Unavailable when unhealthy
+func (h *HealthCheck) Handle(ctx context.Context, _ *Request, res Response) error {
+	report := h.Check(ctx)
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	res.Json(status, report)
+	return nil
+}
+
+func (h *HealthCheck) checkToken(ctx context.Context, tc TokenChecker) error {
+	if err := tc.CheckToken(ctx); err != nil {
+		return ContextualError(err, "CheckToken")
+	}
+	return nil
+}
+
+func (h *HealthCheck) checkHook(ctx context.Context) (*Hook, error) {
+	hooks, err := h.Store.GetHooks(ctx)
+	if err != nil {
+		return nil, ContextualError(err, "GetHooks")
+	}
+	var hook *Hook
+	for i, v := range hooks.Items {
+		if (h.Config.NotificationHookId != "" && v.Id == h.Config.NotificationHookId) ||
+			(h.Config.NotificationHookId == "" && h.Settings != nil && v.Uri == h.Settings.HookUri) {
+			hook = &hooks.Items[i]
+			break
+		}
+	}
+	if hook == nil {
+		return nil, fmt.Errorf("hook %s not found", h.Config.NotificationHookId)
+	}
+	if !hook.Enabled {
+		return hook, fmt.Errorf("hook %s is disabled", hook.Id)
+	}
+	requiredScope, err := mapScope(h.Config)
+	if err != nil {
+		return hook, ContextualError(err, "mapScope")
+	}
+	scope := append([]int(nil), hook.Scope...)
+	sort.Ints(scope)
+	if !reflect.DeepEqual(requiredScope, scope) {
+		return hook, fmt.Errorf("hook %s scope %v, required %v", hook.Id, scope, requiredScope)
+	}
+	return hook, nil
+}
+
+func (h *HealthCheck) checkUndeliverable(hook *Hook) error {
+	if hook.LastUndeliverable == "" {
+		return nil
+	}
+	maxAge := h.MaxUndeliverableAge
+	if maxAge <= 0 {
+		maxAge = defaultMaxUndeliverableAge
+	}
+	at, err := time.Parse(time.RFC3339Nano, hook.LastUndeliverableTimestamp)
+	if err != nil {
+		return fmt.Errorf("undeliverable message %s has invalid timestamp %q", hook.LastUndeliverable, hook.LastUndeliverableTimestamp)
+	}
+	if age := h.now().Sub(at); age > maxAge {
+		return fmt.Errorf("undeliverable message %s is stale, waiting %s", hook.LastUndeliverable, age.Round(time.Second))
+	}
+	return nil
+}
+
+func (h *HealthCheck) now() time.Time {
+	if h.Now != nil {
+		return h.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,74 @@
+package eml
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var healthNow = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func healthConfig() *Config {
+	return &Config{NotificationHookId: "hookId", DisbursementCompanyId: "12345", ProductCompanies: []ProductCompany{{CompanyId: "67890"}}}
+}
+
+func TestHealthCheck_healthy(t *testing.T) {
+	emlStore := &MockStore{}
+	emlStore.On("GetHooks", mock.Anything).Return(&HookPage{Items: []Hook{
+		{Id: "other", Enabled: false},
+		{Id: "hookId", Enabled: true, Scope: []int{67890, 12345}, LastUndeliverable: "m1", LastUndeliverableTimestamp: "2020-06-01T11:30:00Z"},
+	}}, nil)
+	h := &HealthCheck{Config: healthConfig(), Store: emlStore, Now: func() time.Time { return healthNow }}
+
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h.Handle(ctx, nil, NewResponse(rec)))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var report HealthReport
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.True(t, report.Healthy, "expected healthy report %+v", report)
+	assert.Len(t, report.Checks, 3)
+	assert.Equal(t, HealthCheckToken, report.Checks[0].Name)
+	assert.True(t, report.Checks[0].Skipped, "MockStore can't check its token")
+	assert.Contains(t, report.Checks[0].Message, "TokenChecker")
+	emlStore.AssertExpectations(t)
+}
+
+func TestHealthCheck_unhealthy(t *testing.T) {
+	tests := map[string]struct {
+		hook    Hook
+		failing string
+	}{
+		"disabled":      {Hook{Id: "hookId", Enabled: false, Scope: []int{12345, 67890}}, HealthCheckHook},
+		"scope":         {Hook{Id: "hookId", Enabled: true, Scope: []int{12345}}, HealthCheckHook},
+		"stale":         {Hook{Id: "hookId", Enabled: true, Scope: []int{12345, 67890}, LastUndeliverable: "m1", LastUndeliverableTimestamp: "2020-06-01T09:00:00Z"}, HealthCheckUndeliverable},
+		"bad timestamp": {Hook{Id: "hookId", Enabled: true, Scope: []int{12345, 67890}, LastUndeliverable: "m1"}, HealthCheckUndeliverable},
+		"missing hook":  {Hook{Id: "notOurs", Enabled: true, Scope: []int{12345, 67890}}, HealthCheckHook},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			emlStore := &MockStore{}
+			emlStore.On("GetHooks", mock.Anything).Return(&HookPage{Items: []Hook{tt.hook}}, nil)
+			h := &HealthCheck{Config: healthConfig(), Store: emlStore, Now: func() time.Time { return healthNow }}
+
+			rec := httptest.NewRecorder()
+			assert.NoError(t, h.Handle(ctx, nil, NewResponse(rec)))
+
+			assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+			var report HealthReport
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+			assert.False(t, report.Healthy)
+			for _, c := range report.Checks {
+				if c.Name == tt.failing {
+					assert.False(t, c.Healthy, "expected %s check to fail", tt.failing)
+					assert.NotEmpty(t, c.Message)
+				}
+			}
+		})
+	}
+}
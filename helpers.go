@@ -3,7 +3,6 @@ package eml
 import (
 	"context"
 	"github.com/go-resty/resty/v2"
-	"log"
 	"net/http"
 	"strings"
 	"sync/atomic"
@@ -26,19 +25,85 @@ func (e *emlStore) onBeforeRequest(_ *resty.Client, req *resty.Request) error {
 	return nil
 }
 
-func logRequest(_ *resty.Client, req *resty.Request) error {
-	log.Println("EML", req.Method, "Length", req.URL, "->", req.URL)
+func (e *emlStore) logRequest(_ *resty.Client, req *resty.Request) error {
+	e.log().Debug("EML request", KV("method", req.Method), KV("url", req.URL))
 	return nil
 }
 
-func logResponse(_ *resty.Client, res *resty.Response) error {
-	log.Println("EML", res.Status(), "Length", res.Size(), "in", res.Time(), "<-", res.Request.URL)
+func (e *emlStore) logResponse(_ *resty.Client, res *resty.Response) error {
+	fields := []Field{KV("method", res.Request.Method), KV("url", res.Request.URL), KV("status", res.StatusCode()), KV("length", res.Size()), KV("duration", res.Time())}
 	if !res.IsSuccess() {
-		log.Println(string(res.Body()))
+		e.log().Warn("EML response", append(fields, KV("body", string(res.Body())))...)
+		return nil
 	}
+	e.log().Info("EML response", fields...)
+	return nil
+}
+
+func (e *emlStore) redactRequestLog(rl *resty.RequestLog) error {
+	r := redactorOrDefault(e._env.Redactor)
+	rl.Header = r.RedactHeaders(rl.Header)
+	rl.Body = r.Redact(rl.Body)
 	return nil
 }
 
+func (e *emlStore) redactResponseLog(rl *resty.ResponseLog) error {
+	r := redactorOrDefault(e._env.Redactor)
+	rl.Header = r.RedactHeaders(rl.Header)
+	rl.Body = r.Redact(rl.Body)
+	return nil
+}
+
+type requestSpanKey struct{}
+
+type pathIdKey struct{}
+
+// Started before resty substitutes path params, so the endpoint is a low cardinality template
+func (e *emlStore) startRequest(_ *resty.Client, req *resty.Request) error {
+	// Token requests are traced by refreshToken
+	if strings.Contains(req.URL, pathToken) {
+		return nil
+	}
+	ctx := req.Context()
+	span := &Span{Name: SpanRequest, Endpoint: req.URL, Method: req.Method}
+	id, _ := ctx.Value(pathIdKey{}).(string)
+	if strings.HasPrefix(req.URL, "/3.0/hooks") {
+		span.HookId = id
+	} else {
+		span.Eaid = id
+	}
+	ctx = e.tracing().start(ctx, span)
+	if span.CorrelationId != "" {
+		req.SetHeader(headerCorrelationId, span.CorrelationId)
+	}
+	req.SetContext(context.WithValue(ctx, requestSpanKey{}, span))
+	return nil
+}
+
+func (e *emlStore) finishRequest(resp *resty.Response, err error) {
+	if resp == nil || resp.Request == nil {
+		return
+	}
+	ctx := resp.Request.Context()
+	span, ok := ctx.Value(requestSpanKey{}).(*Span)
+	if !ok {
+		return
+	}
+	span.Status = resp.StatusCode()
+	if err == nil && !resp.IsSuccess() {
+		if e, ok := resp.Error().(*ErrorModel); ok {
+			err = e
+		}
+	}
+	e.tracing().end(ctx, span, err)
+	e.metrics().ObserveRequest(span.Endpoint, span.Method, span.Status, span.Duration)
+}
+
+func (e *emlStore) checkError(resp *resty.Response, err error) error {
+	e.finishRequest(resp, err)
+	return checkError(resp, err)
+}
+
 func checkError(resp *resty.Response, err error) error {
 	if err != nil {
 		return ContextualError(err, "resty")
@@ -54,33 +119,48 @@ func checkError(resp *resty.Response, err error) error {
 	return nil
 }
 
+// CheckToken refreshes the access token unless the current one is still valid
+func (e *emlStore) CheckToken(ctx context.Context) error {
+	if e.token.IsValid() && !e.token.ShouldRefresh() {
+		return nil
+	}
+	return e.refreshToken(ctx)
+}
+
 func (e *emlStore) refreshTokenAsync(ctx context.Context) {
 	if atomic.CompareAndSwapUint32(&e.refreshing, 0, 1) {
 		go func() {
 			err := e.refreshToken(ctx)
 			atomic.StoreUint32(&e.refreshing, 0)
 			if err != nil {
-				log.Println("async token refresh error:", err)
+				e.log().Error("Async token refresh failed", ErrField(err))
 			}
 		}()
 	}
 }
 
-func (e *emlStore) refreshToken(ctx context.Context) error {
-	log.Println("Refreshing EML access token")
+func (e *emlStore) refreshToken(ctx context.Context) (err error) {
+	e.log().Info("Refreshing EML access token")
+	span := &Span{Name: SpanTokenRefresh, Endpoint: pathToken, Method: http.MethodPost}
+	ctx = e.tracing().start(ctx, span)
+	defer func() {
+		e.tracing().end(ctx, span, err)
+		e.metrics().ObserveTokenRefresh(err == nil, span.Duration)
+	}()
 	resp, err := e.request(ctx).
 		SetFormData(map[string]string{"grant_type": "client_credentials"}).
 		SetResult(&TokenResponse{}).
 		Post(pathToken)
 	if err != nil {
-		log.Printf("Error Refreshing EML access token : %v", err)
+		e.log().Error("Error refreshing EML access token", ErrField(err))
 		return err
 	}
+	span.Status = resp.StatusCode()
 	if !resp.IsSuccess() {
-		log.Printf("Token Retrieval Unsuccessful : %v", resp.Error())
+		e.log().Error("Token retrieval unsuccessful", KV("status", resp.StatusCode()), ErrField(resp.Error().(*ErrorModel)))
 		return resp.Error().(*ErrorModel)
 	}
-	log.Println("Token Updates")
+	e.log().Info("EML access token updated")
 	e.token = mapBearerToken(resp.Result().(*TokenResponse))
 	return nil
 }
@@ -0,0 +1,308 @@
+package eml
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type HookActionType string
+
+const (
+	HookCreate               HookActionType = "create"
+	HookUpdate               HookActionType = "update"
+	HookProcessUndeliverable HookActionType = "process_undeliverable"
+	HookDelete               HookActionType = "delete"
+)
+
+// HookAction is one change PlanHooks wants to make, with the reason for it
+type HookAction struct {
+	Type   HookActionType
+	HookId string
+	Reason string
+	// For HookCreate, includes the HMAC key secret. For HookUpdate, only the fields that differ.
+	Request *HookRequest
+	// For HookUpdate
+	Differences []HookDifference
+	// For HookProcessUndeliverable
+	LastUndeliverable string
+}
+
+// HookDifference is a field of a registered hook that doesn't match what the config wants
+type HookDifference struct {
+	Field string
+	Have  string
+	Want  string
+}
+
+func (d HookDifference) String() string {
+	return fmt.Sprintf("%s is %q, want %q", d.Field, d.Have, d.Want)
+}
+
+// HookPlan lists the actions to bring EML's hooks in line with the config, review it before ApplyHookPlan
+type HookPlan struct {
+	Actions []HookAction
+	// Things noticed but deliberately left alone, e.g. another team's hook on the same URI
+	Notes []string
+	// Our hook once the plan is applied, ApplyHookPlan fills in the ID of a new hook
+	Hook *HookState
+}
+
+func (p *HookPlan) add(a HookAction) {
+	p.Actions = append(p.Actions, a)
+}
+
+func (p *HookPlan) note(format string, args ...interface{}) {
+	p.Notes = append(p.Notes, fmt.Sprintf(format, args...))
+}
+
+// String describes the plan for review, leaving out key secrets
+func (p *HookPlan) String() string {
+	if len(p.Actions) == 0 && len(p.Notes) == 0 {
+		return "no changes"
+	}
+	var sb strings.Builder
+	for _, a := range p.Actions {
+		if a.HookId != "" {
+			fmt.Fprintf(&sb, "%s %s: %s\n", a.Type, a.HookId, a.Reason)
+		} else {
+			fmt.Fprintf(&sb, "%s: %s\n", a.Type, a.Reason)
+		}
+	}
+	for _, n := range p.Notes {
+		fmt.Fprintf(&sb, "note: %s\n", n)
+	}
+	return sb.String()
+}
+
+// PlanHooks works out what SetupHook would do without changing anything. A hook on our URI is only treated as ours
+// when it has our hook ID or key ID, others are left alone and noted.
+func PlanHooks(ctx context.Context, emlConfig *Config, emlStore Store, s *Settings) (*HookPlan, error) {
+	hooks, err := emlStore.GetHooks(ctx)
+	//Get more hooks if there is a page cursor
+	if err != nil {
+		return nil, ContextualError(err, "emlStore.GetHooks")
+	}
+	sameUri := make([]Hook, 0)
+	for _, v := range hooks.Items {
+		if v.Uri == s.HookUri {
+			sameUri = append(sameUri, v)
+		}
+	}
+
+	plan := &HookPlan{}
+	ours, others := findOurHooks(sameUri, emlConfig)
+	for _, other := range others {
+		if emlConfig.NotificationHookId == "" && emlConfig.HmacKey == nil {
+			plan.note("hook %s also uses %s but no hook ID or key is configured to show it is ours, leaving it alone", other.Id, other.Uri)
+		} else {
+			plan.note("hook %s also uses %s but has key ID %s, leaving it alone", other.Id, other.Uri, other.HmacKeyId)
+		}
+	}
+	key := emlConfig.HmacKey
+	if key == nil {
+		key, err = GenerateSecureKey(32)
+		if err != nil {
+			return nil, ContextualError(err, "utils.GenerateSecureKey")
+		}
+	}
+	wanted, err := mapHookRequest(s, emlConfig, key)
+	if err != nil {
+		return nil, ContextualError(err, "mapHookRequest")
+	}
+	if len(ours) == 0 {
+		plan.add(HookAction{Type: HookCreate, Reason: fmt.Sprintf("no hook of ours is registered for %s", s.HookUri), Request: wanted})
+		plan.Hook = &HookState{Uri: wanted.Uri, Scope: wanted.Scope, Enabled: true, HmacKey: key}
+		return plan, nil
+	}
+	if emlConfig.HmacKey == nil {
+		// We don't know the existing hook's secret, so keep whatever key it has rather than rotating to a new one
+		wanted.HmacKeyId, wanted.HmacKeySecret = "", ""
+	}
+
+	hook, err := emlStore.GetHook(ctx, ours[0].Id)
+	if err != nil {
+		return nil, ContextualError(err, "emlStore.GetHook")
+	}
+	if differences := diffHook(hook, wanted); len(differences) > 0 {
+		reasons := make([]string, len(differences))
+		for i, d := range differences {
+			reasons[i] = d.String()
+		}
+		plan.add(HookAction{Type: HookUpdate, HookId: hook.Id, Request: hookUpdateRequest(wanted, differences), Differences: differences, Reason: strings.Join(reasons, ", ")})
+	}
+	if hook.LastUndeliverable != "" {
+		plan.add(HookAction{Type: HookProcessUndeliverable, HookId: hook.Id, LastUndeliverable: hook.LastUndeliverable, Reason: fmt.Sprintf("undeliverable messages since %s", hook.LastUndeliverableTimestamp)})
+	}
+	plan.Hook = &HookState{HookId: hook.Id, Uri: wanted.Uri, Scope: wanted.Scope, Enabled: true, HmacKey: emlConfig.HmacKey}
+	for _, duplicate := range ours[1:] {
+		plan.add(HookAction{Type: HookDelete, HookId: duplicate.Id, Reason: fmt.Sprintf("duplicate of hook %s with our key ID %s", hook.Id, duplicate.HmacKeyId)})
+	}
+	return plan, nil
+}
+
+// Compares every field of hook EML can change with wanted, a disabled hook shows up as an Enabled difference.
+// The key ID is only compared when wanted has one.
+func diffHook(hook *Hook, wanted *HookRequest) []HookDifference {
+	var differences []HookDifference
+	differs := func(field, have, want string) {
+		if have != want {
+			differences = append(differences, HookDifference{Field: field, Have: have, Want: want})
+		}
+	}
+	differs("uri", hook.Uri, wanted.Uri)
+	scope := append([]int(nil), hook.Scope...)
+	sort.Ints(scope)
+	if !reflect.DeepEqual(scope, wanted.Scope) {
+		differences = append(differences, HookDifference{Field: "scope", Have: fmt.Sprint(scope), Want: fmt.Sprint(wanted.Scope)})
+	}
+	differs("filter_spec", hook.FilterSpec, wanted.FilterSpec)
+	if wanted.Enabled != nil {
+		differs("enabled", strconv.FormatBool(hook.Enabled), strconv.FormatBool(*wanted.Enabled))
+	}
+	differs("reliability_mode", hook.ReliabilityMode, string(wanted.ReliabilityMode))
+	if wanted.HmacKeyId != "" {
+		differs("hmac_key_id", hook.HmacKeyId, wanted.HmacKeyId)
+	}
+	return differences
+}
+
+// Builds a PATCH request with only the fields that differ, changing the key ID needs its secret too
+func hookUpdateRequest(wanted *HookRequest, differences []HookDifference) *HookRequest {
+	request := &HookRequest{}
+	for _, d := range differences {
+		switch d.Field {
+		case "uri":
+			request.Uri = wanted.Uri
+		case "scope":
+			request.Scope = wanted.Scope
+		case "filter_spec":
+			request.FilterSpec = wanted.FilterSpec
+		case "enabled":
+			request.Enabled = wanted.Enabled
+		case "reliability_mode":
+			request.ReliabilityMode = wanted.ReliabilityMode
+		case "hmac_key_id":
+			request.HmacKeyId = wanted.HmacKeyId
+			request.HmacKeySecret = wanted.HmacKeySecret
+		}
+	}
+	return request
+}
+
+// Splits hooks on our URI into ours, the configured hook first, and other people's. With no hook ID or key
+// configured nothing can be proven ours, so every hook is left to its owner and a new one is registered.
+func findOurHooks(hooks []Hook, emlConfig *Config) (ours, others []Hook) {
+	for _, hook := range hooks {
+		switch {
+		case emlConfig.NotificationHookId != "" && hook.Id == emlConfig.NotificationHookId:
+			ours = append([]Hook{hook}, ours...)
+		case emlConfig.HmacKey != nil && hook.HmacKeyId == emlConfig.HmacKey.Id:
+			ours = append(ours, hook)
+		default:
+			others = append(others, hook)
+		}
+	}
+	return ours, others
+}
+
+// ApplyHookPlan makes the changes in plan in order, undeliverable messages are handled by h. A failed delete is
+// logged as the hook still works with a duplicate, any other failure stops the plan. The resulting hook state is
+// returned with any error from processing undeliverable messages.
+func ApplyHookPlan(ctx context.Context, plan *HookPlan, emlStore Store, s *Settings, h TransactionHandler) (*HookState, error) {
+	return applyHookPlan(ctx, plan, emlStore, s, h, nil)
+}
+
+// Saves the hook state to data when set, once the hook is created or updated and before undeliverable messages are
+// processed. It is returned with any error from saving it too.
+func applyHookPlan(ctx context.Context, plan *HookPlan, emlStore Store, s *Settings, h TransactionHandler, data ConfigStore) (*HookState, error) {
+	l := s.logger()
+	for _, note := range plan.Notes {
+		l.Warn("EML hook plan note", KV("note", note))
+	}
+	var state *HookState
+	if plan.Hook != nil {
+		hook := *plan.Hook
+		state = &hook
+	}
+	saved := false
+	save := func() error {
+		if saved || state == nil || data == nil {
+			return nil
+		}
+		saved = true
+		if err := data.SaveHookState(ctx, state); err != nil {
+			return ContextualError(err, "Data.SaveHookState")
+		}
+		return nil
+	}
+	for _, a := range plan.Actions {
+		l.Info("Applying EML hook action", KV("action", a.Type), KV("hookId", a.HookId), KV("reason", a.Reason))
+		switch a.Type {
+		case HookCreate:
+			id, err := emlStore.AddHook(ctx, a.Request)
+			if err != nil {
+				return nil, ContextualError(err, "emlStore.AddHook")
+			}
+			l.Info("Registered new EML webhook", KV("hookId", id), KV("uri", a.Request.Uri))
+			if state != nil {
+				state.HookId = id
+			}
+		case HookUpdate:
+			for _, d := range a.Differences {
+				l.Info("EML hook differs from config", KV("hookId", a.HookId), KV("field", d.Field), KV("have", d.Have), KV("want", d.Want))
+			}
+			if err := updateHook(ctx, emlStore, a, l); err != nil {
+				return nil, err
+			}
+		case HookProcessUndeliverable:
+			// Save first so a failure here doesn't lose a new hook's ID
+			if err := save(); err != nil {
+				return state, err
+			}
+			if err := s.undeliverableProcessor(emlStore, h).processAllUndeliverableMessages(ctx, a.HookId, a.LastUndeliverable); err != nil {
+				return state, err
+			}
+		case HookDelete:
+			if err := emlStore.DeleteHook(ctx, a.HookId); err != nil {
+				l.Warn("Unable to delete hook", KV("hookId", a.HookId), ErrField(err))
+			}
+		default:
+			return nil, fmt.Errorf("unknown hook action %s", a.Type)
+		}
+	}
+	if err := save(); err != nil {
+		// The hook has been changed, the caller still needs its ID and key even though they weren't saved
+		return state, err
+	}
+	return state, nil
+}
+
+// Updates the hook through HookUpdater, or just its scope for stores without it
+func updateHook(ctx context.Context, emlStore Store, a HookAction, l Logger) error {
+	if updater, ok := emlStore.(HookUpdater); ok {
+		if err := updater.UpdateHook(ctx, a.HookId, a.Request); err != nil {
+			return ContextualError(err, "emlStore.UpdateHook")
+		}
+		return nil
+	}
+	var skipped []string
+	for _, d := range a.Differences {
+		if d.Field != "scope" {
+			skipped = append(skipped, d.Field)
+		}
+	}
+	if len(skipped) > 0 {
+		l.Warn("Store can't update EML hook fields, implement HookUpdater to reconcile them", KV("hookId", a.HookId), KV("fields", skipped))
+	}
+	if a.Request.Scope == nil {
+		return nil
+	}
+	if err := emlStore.UpdateHookScope(ctx, a.HookId, a.Request.Scope); err != nil {
+		return ContextualError(err, "emlStore.UpdateHookScope")
+	}
+	return nil
+}
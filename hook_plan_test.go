@@ -0,0 +1,214 @@
+package eml
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func testHookConfig() *Config {
+	return &Config{
+		NotificationHookId:    "hook1",
+		HmacKey:               testHmacKey,
+		DisbursementCompanyId: "12345",
+		ProductCompanies:      []ProductCompany{{CompanyId: "67890"}},
+	}
+}
+
+func TestPlanHooks_new(t *testing.T) {
+	store := &MockStore{}
+	s := &Settings{HookUri: "http://function/eml"}
+	store.On("GetHooks", ctx).Return(&HookPage{Items: []Hook{{Id: "other", Uri: "http://other/eml"}}}, nil)
+
+	plan, err := PlanHooks(ctx, testHookConfig(), store, s)
+	assert.NoError(t, err)
+	assert.Len(t, plan.Actions, 1)
+	assert.Equal(t, HookCreate, plan.Actions[0].Type)
+	assert.Equal(t, []int{12345, 67890}, plan.Actions[0].Request.Scope)
+	assert.Equal(t, testHmacKey.Id, plan.Actions[0].Request.HmacKeyId)
+	assert.NotContains(t, plan.String(), plan.Actions[0].Request.HmacKeySecret)
+	store.AssertNotCalled(t, "AddHook", mock.Anything, mock.Anything)
+}
+
+func TestSetupHook_existing(t *testing.T) {
+	store := &MockStore{}
+	s := &Settings{HookUri: "http://function/eml"}
+	store.On("GetHooks", ctx).Return(&HookPage{Items: []Hook{
+		{Id: "hook1", Uri: s.HookUri, HmacKeyId: "key1"},
+		{Id: "dup", Uri: s.HookUri, HmacKeyId: "key1"},
+		{Id: "theirs", Uri: s.HookUri, HmacKeyId: "their-key"},
+	}}, nil)
+	store.On("GetHook", ctx, "hook1").Return(&Hook{Id: "hook1", Uri: s.HookUri, Scope: []int{67890}, FilterSpec: FilterSpecAll,
+		Enabled: true, ReliabilityMode: string(StoreUndeliverable), HmacKeyId: "key1", LastUndeliverable: "1"}, nil)
+	store.On("UpdateHook", ctx, "hook1", &HookRequest{Scope: []int{12345, 67890}}).Return(nil)
+	store.On("GetUndeliverable", ctx, "hook1", 20, 1).Return(&MessagePage{Items: []Message{{Id: "1"}}}, nil)
+	store.On("DismissUndeliverable", ctx, "hook1", []string{"1"}).Return(nil)
+	store.On("DeleteHook", ctx, "dup").Return(nil)
+
+	plan, err := PlanHooks(ctx, testHookConfig(), store, s)
+	assert.NoError(t, err)
+	var types []HookActionType
+	for _, a := range plan.Actions {
+		types = append(types, a.Type)
+	}
+	assert.Equal(t, []HookActionType{HookUpdate, HookProcessUndeliverable, HookDelete}, types)
+	assert.Len(t, plan.Notes, 1, "other teams' hooks are noted, not deleted")
+
+	state, err := SetupHook(ctx, testHookConfig(), store, s, func(ctx context.Context, m *Message) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "hook1", state.HookId)
+	store.AssertExpectations(t)
+	store.AssertNotCalled(t, "DeleteHook", ctx, "theirs")
+}
+
+func TestPlanHooks_reconcile(t *testing.T) {
+	store := &MockStore{}
+	s := &Settings{HookUri: "http://function/eml"}
+	hook := Hook{Id: "hook1", Uri: s.HookUri, Scope: []int{67890, 12345}, FilterSpec: "account.*", Enabled: false,
+		ReliabilityMode: string(None), HmacKeyId: "old-key"}
+	store.On("GetHooks", ctx).Return(&HookPage{Items: []Hook{hook}}, nil)
+	store.On("GetHook", ctx, "hook1").Return(&hook, nil)
+
+	plan, err := PlanHooks(ctx, testHookConfig(), store, s)
+	assert.NoError(t, err)
+	assert.Len(t, plan.Actions, 1)
+	a := plan.Actions[0]
+	assert.Equal(t, HookUpdate, a.Type)
+	var fields []string
+	for _, d := range a.Differences {
+		fields = append(fields, d.Field)
+	}
+	assert.Equal(t, []string{"filter_spec", "enabled", "reliability_mode", "hmac_key_id"}, fields, "scope order doesn't matter")
+	assert.True(t, *a.Request.Enabled, "disabled hooks are re-enabled")
+	assert.Equal(t, StoreUndeliverable, a.Request.ReliabilityMode)
+	assert.Equal(t, FilterSpecAll, a.Request.FilterSpec)
+	assert.Equal(t, "key1", a.Request.HmacKeyId)
+	assert.NotEmpty(t, a.Request.HmacKeySecret, "a new key ID needs its secret")
+	assert.Nil(t, a.Request.Scope)
+	assert.Contains(t, plan.String(), `enabled is "false", want "true"`)
+	assert.NotContains(t, plan.String(), a.Request.HmacKeySecret)
+}
+
+func TestSetupHook_savesNewHook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hook.json")
+	data, err := NewFileConfigStore(path)
+	assert.NoError(t, err)
+	store := &MockStore{}
+	s := &Settings{HookUri: "http://function/eml"}
+	store.On("GetHooks", ctx).Return(&HookPage{}, nil)
+	store.On("AddHook", ctx, mock.AnythingOfType("*eml.HookRequest")).Return("new-hook", nil)
+
+	config := &Config{DisbursementCompanyId: "12345"}
+	deps := &Dependencies{Config: config, Store: store, Data: data}
+	state, err := deps.SetupHook(ctx, s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "new-hook", state.HookId)
+	assert.NotNil(t, state.HmacKey, "the generated key is kept")
+	assert.Equal(t, "new-hook", config.NotificationHookId)
+	assert.Equal(t, state.HmacKey, config.HmacKey)
+
+	// After a restart the saved hook is kept rather than another being added
+	reopened, err := NewFileConfigStore(path)
+	assert.NoError(t, err)
+	restartedStore := &MockStore{}
+	restartedStore.On("GetHooks", ctx).Return(&HookPage{Items: []Hook{{Id: "new-hook", Uri: s.HookUri, HmacKeyId: state.HmacKey.Id}}}, nil)
+	restartedStore.On("GetHook", ctx, "new-hook").Return(&Hook{Id: "new-hook", Uri: s.HookUri, Scope: []int{12345}, FilterSpec: FilterSpecAll,
+		Enabled: true, ReliabilityMode: string(StoreUndeliverable), HmacKeyId: state.HmacKey.Id}, nil)
+	restarted := &Config{DisbursementCompanyId: "12345"}
+	restartedDeps := &Dependencies{Config: restarted, Store: restartedStore, Data: reopened}
+	restartedState, err := restartedDeps.SetupHook(ctx, s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "new-hook", restartedState.HookId)
+	assert.Equal(t, "new-hook", restarted.NotificationHookId)
+	assert.Equal(t, state.HmacKey, restarted.HmacKey)
+	restartedStore.AssertNotCalled(t, "AddHook", mock.Anything, mock.Anything)
+	restartedStore.AssertNotCalled(t, "UpdateHook", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPlanHooks_unprovenOwnership(t *testing.T) {
+	store := &MockStore{}
+	s := &Settings{HookUri: "http://function/eml"}
+	store.On("GetHooks", ctx).Return(&HookPage{Items: []Hook{{Id: "maybe", Uri: s.HookUri, HmacKeyId: "unknown", LastUndeliverable: "1"}}}, nil)
+
+	config := testHookConfig()
+	config.NotificationHookId, config.HmacKey = "", nil
+	plan, err := PlanHooks(ctx, config, store, s)
+	assert.NoError(t, err)
+	assert.Len(t, plan.Actions, 1)
+	assert.Equal(t, HookCreate, plan.Actions[0].Type, "a hook that can't be shown to be ours isn't adopted")
+	assert.Len(t, plan.Notes, 1)
+	store.AssertNotCalled(t, "GetHook", mock.Anything, mock.Anything)
+}
+
+// A Store without HookUpdater
+type scopeOnlyStore struct {
+	Store
+}
+
+func TestApplyHookPlan_scopeOnlyStore(t *testing.T) {
+	store := &MockStore{}
+	store.On("UpdateHookScope", ctx, "hook1", []int{12345, 67890}).Return(nil)
+	enabled := true
+	plan := &HookPlan{Actions: []HookAction{{
+		Type:        HookUpdate,
+		HookId:      "hook1",
+		Request:     &HookRequest{Scope: []int{12345, 67890}, Enabled: &enabled},
+		Differences: []HookDifference{{Field: "scope"}, {Field: "enabled"}},
+	}}}
+	l := &recordingLogger{}
+
+	_, err := ApplyHookPlan(ctx, plan, scopeOnlyStore{store}, &Settings{Logger: l}, nil)
+	assert.NoError(t, err)
+	store.AssertExpectations(t)
+	var warned bool
+	for _, e := range l.entries {
+		warned = warned || e.level == LevelWarn
+	}
+	assert.True(t, warned, "fields it can't update are reported")
+}
+
+func TestSetupHook_dependenciesUndeliverable(t *testing.T) {
+	store := &MockStore{}
+	s := &Settings{HookUri: "http://function/eml", Undeliverable: &UndeliverableOptions{LeaseHolder: "ignored"}}
+	store.On("GetHooks", ctx).Return(&HookPage{Items: []Hook{{Id: "hook1", Uri: s.HookUri, HmacKeyId: "key1"}}}, nil)
+	store.On("GetHook", ctx, "hook1").Return(&Hook{Id: "hook1", Uri: s.HookUri, Scope: []int{12345, 67890}, FilterSpec: FilterSpecAll,
+		Enabled: true, ReliabilityMode: string(StoreUndeliverable), HmacKeyId: "key1", LastUndeliverable: "1"}, nil)
+
+	// The webhook's instance holds the lease, so setup leaves the messages to it
+	lease := NewMemoryLease()
+	ok, _ := lease.Acquire(ctx, "eml-undeliverable-hook1", "webhook", time.Minute)
+	assert.True(t, ok)
+	deps := &Dependencies{Config: testHookConfig(), Store: store, Undeliverable: &UndeliverableOptions{Lease: lease, LeaseHolder: "setup"}}
+	_, err := deps.SetupHook(ctx, s, func(ctx context.Context, m *Message) error { return nil })
+	assert.NoError(t, err)
+	store.AssertNotCalled(t, "GetUndeliverable", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(t, "ignored", s.Undeliverable.LeaseHolder, "settings aren't changed")
+}
+
+type failingConfigStore struct {
+	*MemoryConfigStore
+}
+
+func (failingConfigStore) SaveHookState(context.Context, *HookState) error {
+	return errors.New("disk full")
+}
+
+func TestSetupHook_saveFails(t *testing.T) {
+	store := &MockStore{}
+	s := &Settings{HookUri: "http://function/eml"}
+	store.On("GetHooks", ctx).Return(&HookPage{}, nil)
+	store.On("AddHook", ctx, mock.AnythingOfType("*eml.HookRequest")).Return("new-hook", nil)
+
+	config := &Config{DisbursementCompanyId: "12345"}
+	deps := &Dependencies{Config: config, Store: store, Data: failingConfigStore{NewMemoryConfigStore()}}
+	state, err := deps.SetupHook(ctx, s, nil)
+	assert.Error(t, err)
+	assert.Equal(t, "new-hook", state.HookId, "the new hook's ID and key aren't lost")
+	assert.NotNil(t, state.HmacKey)
+	assert.Equal(t, "new-hook", config.NotificationHookId)
+}
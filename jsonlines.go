@@ -0,0 +1,95 @@
+package eml
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Calls fn with each line of a JSON lines file, a missing file has no lines
+func readJsonLines(path string, fn func(line []byte)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return ContextualError(err, "os.Open %s", path)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		return ContextualError(err, "scanner.Scan %s", path)
+	}
+	return nil
+}
+
+// Replaces path with whatever fn encodes, via a temporary file so a crash leaves the old or new file intact
+func rewriteJsonLines(path string, fn func(enc *json.Encoder) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return ContextualError(err, "ioutil.TempFile")
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	if err := fn(json.NewEncoder(w)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return ContextualError(err, "bufio.Flush")
+	}
+	if err := tmp.Close(); err != nil {
+		return ContextualError(err, "file.Close")
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return ContextualError(err, "os.Rename")
+	}
+	return nil
+}
+
+// jsonLinesFile appends values to a file, one per line
+type jsonLinesFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openJsonLines(path string) (*jsonLinesFile, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, ContextualError(err, "os.OpenFile %s", path)
+	}
+	return &jsonLinesFile{file: f}, nil
+}
+
+// Writes v as a single line, syncing when the caller is about to acknowledge something it must not lose
+func (j *jsonLinesFile) append(v interface{}, sync bool) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ContextualError(err, "json.Marshal")
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		return ContextualError(err, "file.Write")
+	}
+	if sync {
+		if err := j.file.Sync(); err != nil {
+			return ContextualError(err, "file.Sync")
+		}
+	}
+	return nil
+}
+
+func (j *jsonLinesFile) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
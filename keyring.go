@@ -0,0 +1,125 @@
+package eml
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyLookup finds the HMAC key for the key ID in a webhook's Authorization header
+type KeyLookup interface {
+	LookupKey(id string) (*Key, error)
+}
+
+type ringKey struct {
+	key       *Key
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+func (r *ringKey) validAt(t time.Time) bool {
+	return (r.notBefore.IsZero() || !t.Before(r.notBefore)) && (r.notAfter.IsZero() || t.Before(r.notAfter))
+}
+
+// KeyRing holds several HMAC keys by ID so a hook can move to a new key while messages signed with the old one
+// are still arriving
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys map[string]*ringKey
+	now  func() time.Time
+}
+
+// NewKeyRing holds keys which are valid until retired
+func NewKeyRing(keys ...*Key) *KeyRing {
+	k := &KeyRing{keys: map[string]*ringKey{}, now: time.Now}
+	for _, key := range keys {
+		k.Add(key, time.Time{}, time.Time{})
+	}
+	return k
+}
+
+// Add replaces any key with the same ID, a zero notBefore or notAfter leaves that end of the window open
+func (k *KeyRing) Add(key *Key, notBefore, notAfter time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key.Id] = &ringKey{key: key, notBefore: notBefore, notAfter: notAfter}
+}
+
+// Retire stops accepting a key from the given time, e.g. a grace period after the hook moved to a new key
+func (k *KeyRing) Retire(id string, at time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	r, ok := k.keys[id]
+	if !ok {
+		return fmt.Errorf("unknown key ID %s", id)
+	}
+	r.notAfter = at
+	return nil
+}
+
+func (k *KeyRing) Remove(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, id)
+}
+
+func (k *KeyRing) LookupKey(id string) (*Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	r, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %s", id)
+	}
+	if now := k.now(); !r.validAt(now) {
+		return nil, fmt.Errorf("key ID %s is not valid at %s", id, now.Format(time.RFC3339))
+	}
+	return r.key, nil
+}
+
+func (k *KeyRing) has(id string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	_, ok := k.keys[id]
+	return ok
+}
+
+// Ids lists the keys currently valid, sorted
+func (k *KeyRing) Ids() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := k.now()
+	ids := make([]string, 0, len(k.keys))
+	for id, r := range k.keys {
+		if r.validAt(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Also accepts a key the ring doesn't know, e.g. one saved by SetupHook, without adding it to the shared ring
+type ringWithKey struct {
+	ring *KeyRing
+	key  *Key
+}
+
+func (r ringWithKey) LookupKey(id string) (*Key, error) {
+	if id == r.key.Id && !r.ring.has(id) {
+		return r.key, nil
+	}
+	return r.ring.LookupKey(id)
+}
+
+// Matches any key ID, as CheckHmacSignature always has
+type singleKey struct {
+	key *Key
+}
+
+func (s singleKey) LookupKey(id string) (*Key, error) {
+	if s.key == nil {
+		return nil, fmt.Errorf("unknown key ID %s", id)
+	}
+	return s.key, nil
+}
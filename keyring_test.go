@@ -0,0 +1,38 @@
+package eml
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRing_LookupKey(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	oldKey := &Key{Id: "old", Secret: "b2xk"}
+	newKey := &Key{Id: "new", Secret: "bmV3"}
+	ring := NewKeyRing(oldKey)
+	ring.now = func() time.Time { return now }
+	ring.Add(newKey, now, time.Time{})
+
+	key, err := ring.LookupKey("old")
+	assert.NoError(t, err)
+	assert.Equal(t, oldKey, key)
+	key, err = ring.LookupKey("new")
+	assert.NoError(t, err)
+	assert.Equal(t, newKey, key)
+	_, err = ring.LookupKey("other")
+	assert.Error(t, err)
+
+	assert.NoError(t, ring.Retire("old", now.Add(time.Hour)))
+	_, err = ring.LookupKey("old")
+	assert.NoError(t, err, "retired keys are accepted during the grace period")
+	now = now.Add(2 * time.Hour)
+	_, err = ring.LookupKey("old")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"new"}, ring.Ids())
+
+	ring.Add(&Key{Id: "future", Secret: "ZnV0"}, now.Add(time.Hour), time.Time{})
+	_, err = ring.LookupKey("future")
+	assert.Error(t, err, "keys aren't accepted before their window")
+}
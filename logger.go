@@ -0,0 +1,132 @@
+package eml
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Field is a single key/value pair attached to a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func KV(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func ErrField(err error) Field {
+	return Field{Key: "error", Value: err}
+}
+
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+type nopLogger struct{}
+
+// NopLogger discards everything, it is the default when no Logger is configured
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debug(string, ...Field) {}
+func (nopLogger) Info(string, ...Field)  {}
+func (nopLogger) Warn(string, ...Field)  {}
+func (nopLogger) Error(string, ...Field) {}
+
+type stdLogger struct {
+	l   *log.Logger
+	min LogLevel
+}
+
+// NewStdLogger adapts a standard library logger, a nil logger writes through the log package defaults
+func NewStdLogger(l *log.Logger, min LogLevel) Logger {
+	return &stdLogger{l: l, min: min}
+}
+
+func (s *stdLogger) Debug(msg string, fields ...Field) { s.log(LevelDebug, msg, fields) }
+func (s *stdLogger) Info(msg string, fields ...Field)  { s.log(LevelInfo, msg, fields) }
+func (s *stdLogger) Warn(msg string, fields ...Field)  { s.log(LevelWarn, msg, fields) }
+func (s *stdLogger) Error(msg string, fields ...Field) { s.log(LevelError, msg, fields) }
+
+func (s *stdLogger) log(level LogLevel, msg string, fields []Field) {
+	if level < s.min {
+		return
+	}
+	line := formatLogLine(level, msg, fields)
+	if s.l == nil {
+		log.Output(3, line)
+	} else {
+		s.l.Output(3, line)
+	}
+}
+
+func formatLogLine(level LogLevel, msg string, fields []Field) string {
+	var sb strings.Builder
+	sb.WriteString(level.String())
+	sb.WriteString(" ")
+	sb.WriteString(msg)
+	for _, f := range fields {
+		v := fmt.Sprintf("%v", f.Value)
+		if strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		sb.WriteString(" ")
+		sb.WriteString(f.Key)
+		sb.WriteString("=")
+		sb.WriteString(v)
+	}
+	return sb.String()
+}
+
+// Routes resty's own logging, including DebugRest dumps, through a Logger
+type restyLogger struct {
+	Logger
+}
+
+func (r restyLogger) Errorf(format string, v ...interface{}) {
+	r.Error(fmt.Sprintf(format, v...))
+}
+
+func (r restyLogger) Warnf(format string, v ...interface{}) {
+	r.Warn(fmt.Sprintf(format, v...))
+}
+
+func (r restyLogger) Debugf(format string, v ...interface{}) {
+	r.Debug(fmt.Sprintf(format, v...))
+}
+
+func loggerOrNop(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
@@ -0,0 +1,28 @@
+//go:build go1.21
+// +build go1.21
+
+package eml
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+	l.Debug("debug")
+	l.Info("Hook registered", KV("hookId", "hook1"), KV("scope", []int{1, 2}))
+	assert.Equal(t, "level=INFO msg=\"Hook registered\" hookId=hook1 scope=\"[1 2]\"\n", buf.String())
+}
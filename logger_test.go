@@ -0,0 +1,25 @@
+package eml
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStdLogger_level(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), LevelWarn)
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+	assert.Equal(t, "WARN warn\nERROR error\n", buf.String())
+}
+
+func TestFormatLogLine(t *testing.T) {
+	line := formatLogLine(LevelInfo, "Hook registered", []Field{KV("hookId", "hook1"), KV("uri", "http://x/ y"), ErrField(errors.New("a=b"))})
+	assert.Equal(t, `INFO Hook registered hookId=hook1 uri="http://x/ y" error="a=b"`, line)
+}
@@ -5,165 +5,245 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"log"
-	"reflect"
-	"sort"
+	"sync"
+	"time"
 )
 
-func SetupHook(ctx context.Context, emlConfig *Config, emlStore Store, s *Settings, h TransactionHandler) error {
-	hooks, err := emlStore.GetHooks(ctx)
-	//Get more hooks if there is a page cursor
-	if err != nil {
-		return ContextualError(err, "emlStore.GetHooks")
-	}
+// SetupHook registers or updates our webhook and processes any undeliverable messages, applying PlanHooks without
+// review. emlConfig is pointed at the resulting hook and its key. Use Dependencies.SetupHook to save them too.
+func SetupHook(ctx context.Context, emlConfig *Config, emlStore Store, s *Settings, h TransactionHandler) (*HookState, error) {
+	return setupHook(ctx, emlConfig, emlStore, s, h, nil)
+}
 
-	myHooks := make([]Hook, 0)
-	for _, v := range hooks.Items {
-		//if v.HmacKeyId == emlConfig.NotificationHookId && v.Uri == s.HookUri {
-		if v.Uri == s.HookUri {
-			myHooks = append(myHooks, v)
-		}
+// SetupHook is SetupHook with the dependencies' Config and Store, saving the hook ID and key to Data when set so
+// webhooks and the next start can load them. Undeliverable messages are processed with Dependencies.Undeliverable,
+// the same lease and failure counts as webhooks and the poller, rather than Settings.Undeliverable. Config is changed
+// without locking, so run it before serving webhooks or polling.
+func (d *Dependencies) SetupHook(ctx context.Context, s *Settings, h TransactionHandler) (*HookState, error) {
+	settings := Settings{}
+	if s != nil {
+		settings = *s
 	}
+	settings.Undeliverable = d.Undeliverable
+	return setupHook(ctx, d.Config, d.Store, &settings, h, d.Data)
+}
 
-	if len(myHooks) == 0 {
-		_, _, err := registerNewHook(ctx, emlConfig, emlStore, s, emlConfig.HmacKey)
-		return err
+func setupHook(ctx context.Context, emlConfig *Config, emlStore Store, s *Settings, h TransactionHandler, data ConfigStore) (*HookState, error) {
+	if emlConfig.NotificationHookId == "" && data != nil {
+		// Without the saved hook and key, the hook from before a restart can't be proven ours and another is added
+		if err := emlConfig.LoadHookState(ctx, data); err != nil {
+			return nil, err
+		}
 	}
-
-	err = checkHookStatus(ctx, emlConfig, emlStore, myHooks[0].Id, h)
+	plan, err := PlanHooks(ctx, emlConfig, emlStore, s)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	state, err := applyHookPlan(ctx, plan, emlStore, s, h, data)
+	emlConfig.ApplyHookState(state)
+	return state, err
+}
 
-	scope := myHooks[0].Scope
-	for _, hook := range myHooks[1:] {
-		scope = append(scope, hook.Scope...)
-		//Remove the extra hooks, they will be covered by the updated scope
-		err = emlStore.DeleteHook(ctx, hook.Id)
-		if err != nil {
-			log.Printf("Unable to delete hook: %v, due to %v", hook.Id, err)
-		}
-	}
+type undeliverableProcessor struct {
+	store   Store
+	handler TransactionHandler
+	log     Logger
+	metrics MetricsRecorder
+	tracing *TraceHooks
+	options *UndeliverableOptions
+}
 
-	return nil
+type handledMessage struct {
+	message *Message
+	err     error
+	// Not handled because an earlier message for the same account failed
+	skipped bool
 }
 
-func registerNewHook(ctx context.Context, emlConfig *Config, emlStore Store, s *Settings, key *Key) (*Key, *string, error) {
-	log.Println("Registering new EML webhook")
-	var err error
-	if key == nil {
-		key, err = GenerateSecureKey(32)
-		if err != nil {
-			return nil, nil, ContextualError(err, "utils.GenerateSecureKey")
-		}
-	}
-	newHookRequest, err := mapHookRequest(s, emlConfig, key)
-	if err != nil {
-		return nil, nil, ContextualError(err, "mapHookRequest")
+func (s *Settings) undeliverableProcessor(emlStore Store, h TransactionHandler) *undeliverableProcessor {
+	p := &undeliverableProcessor{store: emlStore, handler: h, log: s.logger(), metrics: s.metrics()}
+	if s != nil {
+		p.tracing = s.Tracing
+		p.options = s.Undeliverable
 	}
-	id, err := emlStore.AddHook(ctx, newHookRequest)
-	if err != nil {
-		return nil, nil, ContextualError(err, "emlStore.AddHook")
-	}
-	return key, &id, nil
+	return p
+}
+
+func (d *Dependencies) undeliverableProcessor(h TransactionHandler) *undeliverableProcessor {
+	return &undeliverableProcessor{store: d.Store, handler: h, log: d.logger(), metrics: d.metrics(), tracing: d.tracing(), options: d.Undeliverable}
 }
 
-func checkHookStatus(ctx context.Context, emlConfig *Config, emlStore Store, hookId string, h TransactionHandler) error {
-	log.Println("Checking status of existing EML webhook", hookId)
-	hook, err := emlStore.GetHook(ctx, hookId)
+// Handles every undeliverable message for the hook, dismissing them in batches as they succeed. Does nothing when
+// another instance holds the hook's lease. Losing the lease stops handling, but messages already handled are still
+// dismissed with ctx so they aren't redelivered and handled twice.
+func (p *undeliverableProcessor) processAllUndeliverableMessages(ctx context.Context, hookId, lastMessageId string) error {
+	leaseCtx, release, ok, err := p.takeLease(ctx, hookId)
 	if err != nil {
-		return ContextualError(err, "emlStore.GetHook")
+		return ContextualError(err, "lease.Acquire")
 	}
-	requiredScope, err := mapScope(emlConfig)
-	if err != nil {
-		return ContextualError(err, "mapScope")
+	if !ok {
+		p.log.Info("Another instance is processing undelivered messages", KV("hookId", hookId))
+		return nil
 	}
-	sort.Ints(hook.Scope)
-	if !reflect.DeepEqual(requiredScope, hook.Scope) {
-		log.Println("Hook", hook.Id, "scopes don't match,", hook.Scope, "required:", requiredScope)
-		if err := emlStore.UpdateHookScope(ctx, hook.Id, requiredScope); err != nil {
-			return ContextualError(err, "emlStore.UpdateHookScope")
+	defer release()
+	start := time.Now()
+	messages := p.collectMessages(leaseCtx, hookId)
+	results := p.handleMessages(leaseCtx, messages)
+	progress := UndeliverableProgress{HookId: hookId}
+	batchSize := p.options.dismissBatchSize()
+	batch := make([]string, 0, batchSize)
+	backlog := 0
+	dismiss := func() {
+		if len(batch) == 0 {
+			return
 		}
+		if err := p.store.DismissUndeliverable(ctx, hookId, batch); err != nil {
+			p.log.Error("Error dismissing undelivered messages", KV("hookId", hookId), KV("messageIds", batch), ErrField(err))
+			backlog += len(batch)
+		} else {
+			progress.Dismissed += len(batch)
+		}
+		batch = make([]string, 0, batchSize)
+		p.reportProgress(progress)
 	}
-	if hook.LastUndeliverable != "" {
-		log.Println("Hook", hook.Id, "has undelivered messages", hook.LastUndeliverable, hook.LastUndeliverableTimestamp)
-		return processAllUndeliverableMessages(ctx, hook.Id, hook.LastUndeliverable, emlStore, h)
-	}
-	return nil
-}
-
-func processAllUndeliverableMessages(ctx context.Context, hookId, lastMessageId string, emlStore Store, h TransactionHandler) error {
-	messages := collectMessages(ctx, hookId, emlStore)
-	resolvedIds := handleMessages(ctx, messages, h)
-	idList := make([]string, 0)
 	handledLastMessage := false
-	for id := range resolvedIds {
-		idList = append(idList, id)
+	for result := range results {
+		id := result.message.Id
+		if result.skipped {
+			backlog++
+			continue
+		}
+		if result.err != nil {
+			progress.Failed++
+			// A handler stopped because the lease was lost didn't fail on its own account, so it isn't counted
+			// towards dead-lettering
+			if leaseCtx.Err() != nil || !p.deadLetter(ctx, result.message, result.err) {
+				backlog++
+				continue
+			}
+			progress.DeadLettered++
+		} else {
+			progress.Handled++
+			if p.options.deadLettering() {
+				if err := p.options.failures().Reset(ctx, id); err != nil {
+					p.log.Error("Error resetting undelivered message failures", KV("messageId", id), ErrField(err))
+				}
+			}
+		}
+		batch = append(batch, id)
 		if id == lastMessageId {
 			handledLastMessage = true
 		}
-	}
-	if len(idList) > 0 {
-		err := emlStore.DismissUndeliverable(ctx, hookId, idList)
-		if err != nil {
-			log.Println("Error dismissing messages IDs:", err)
+		if len(batch) >= batchSize {
+			dismiss()
 		}
 	}
+	dismiss()
+	progress.Done = true
+	p.reportProgress(progress)
+	p.metrics.ObserveUndeliverable(hookId, progress.Handled, progress.Failed, time.Since(start))
+	p.metrics.SetUndeliverableBacklog(hookId, backlog)
 	if !handledLastMessage {
 		return fmt.Errorf("last message with ID %s was not handled", lastMessageId)
 	}
 	return nil
 }
 
-func collectMessages(ctx context.Context, hookId string, emlStore Store) <-chan Message {
+func (p *undeliverableProcessor) reportProgress(progress UndeliverableProgress) {
+	p.log.Info("Undelivered message progress", KV("hookId", progress.HookId), KV("handled", progress.Handled), KV("failed", progress.Failed), KV("dismissed", progress.Dismissed), KV("deadLettered", progress.DeadLettered), KV("done", progress.Done))
+	p.options.onProgress(progress)
+}
+
+// Reads every page before any message is handled. Dismissing shrinks EML's list, so reading page N+1 after a
+// dismissal would skip a page worth of messages.
+func (p *undeliverableProcessor) collectMessages(ctx context.Context, hookId string) <-chan Message {
 	out := make(chan Message)
 	go func() {
 		defer func() {
 			close(out)
 		}()
+		var messages []Message
 		page := &MessagePage{More: true, PageSize: 20}
 		var err error
 		for pageNumber := 1; page.More; pageNumber++ {
-			page, err = emlStore.GetUndeliverable(ctx, hookId, page.PageSize, pageNumber)
+			page, err = p.store.GetUndeliverable(ctx, hookId, page.PageSize, pageNumber)
 			if err != nil {
-				log.Println("emlStore.GetUndeliverable:", err)
-				return
+				p.log.Error("emlStore.GetUndeliverable failed", KV("hookId", hookId), KV("pageNumber", pageNumber), ErrField(err))
+				break
 			}
-			log.Println("Got page", pageNumber, "of undelivered messages:", len(page.Items), "more:", page.More)
-			for _, message := range page.Items {
-				select {
-				case out <- message:
-				case <-ctx.Done():
-					return
-				}
+			p.log.Info("Got page of undelivered messages", KV("hookId", hookId), KV("pageNumber", pageNumber), KV("count", len(page.Items)), KV("more", page.More))
+			messages = append(messages, page.Items...)
+		}
+		for _, message := range messages {
+			select {
+			case out <- message:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 	return out
 }
 
-func handleMessages(ctx context.Context, messages <-chan Message, h TransactionHandler) <-chan string {
-	out := make(chan string)
+// Handles messages on a pool of workers, each account's messages on the same worker so they stay in order
+func (p *undeliverableProcessor) handleMessages(ctx context.Context, messages <-chan Message) <-chan handledMessage {
+	out := make(chan handledMessage)
+	workers := make([]chan Message, p.options.workers())
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = make(chan Message, 16)
+		wg.Add(1)
+		go func(in <-chan Message) {
+			defer wg.Done()
+			// Accounts with a failed message, their later messages wait so they aren't handled before it
+			failed := map[string]bool{}
+			for message := range in {
+				if ctx.Err() != nil {
+					continue
+				}
+				message := message
+				key := undeliverableOrderKey(&message)
+				if failed[key] {
+					p.log.Info("Skipping undelivered message after an earlier failure for its account", KV("messageId", message.Id), KV("eaid", message.Data.AccountId))
+					out <- handledMessage{message: &message, skipped: true}
+					continue
+				}
+				err := p.handleMessage(ctx, &message)
+				if err != nil {
+					p.log.Error("Error handling undelivered transaction", KV("messageId", message.Id), ErrField(err))
+					failed[key] = true
+				}
+				// Always reported, even once ctx is done, so a handled message still gets dismissed
+				out <- handledMessage{message: &message, err: err}
+			}
+		}(workers[i])
+	}
 	go func() {
 		defer func() {
 			close(out)
 		}()
 		for message := range messages {
-			err := h(ctx, &message)
-			if err == nil {
-				select {
-				case out <- message.Id:
-				case <-ctx.Done():
-					return
-				}
-			} else {
-				log.Println("error handling undelivered transaction", err)
-			}
+			workers[undeliverableWorker(&message, len(workers))] <- message
+		}
+		for _, in := range workers {
+			close(in)
 		}
+		wg.Wait()
 	}()
 	return out
 }
 
+func (p *undeliverableProcessor) handleMessage(ctx context.Context, message *Message) (err error) {
+	span := &Span{Name: SpanUndeliverable, MessageType: message.Type}
+	ctx = p.tracing.start(ctx, span)
+	ctx = traceMessage(ctx, span, message)
+	defer func() {
+		span.Status = errorStatus(err)
+		p.tracing.end(ctx, span, err)
+	}()
+	return Recover(p.log)(p.handler)(ctx, message)
+}
+
 func GenerateSecureKey(numBytes int) (*Key, error) {
 	b := make([]byte, numBytes)
 	if _, err := rand.Read(b); err != nil {
@@ -1,7 +1,6 @@
 package eml
 
 import (
-	"log"
 	"sort"
 	"strconv"
 	"time"
@@ -31,6 +30,9 @@ func mapRegistrationUpdate(account *AccountInfo, info RegistrationInfo) *UpdateA
 
 func mapHookRequest(s *Settings, emlConfig *Config, key *Key) (*HookRequest, error) {
 	scope, err := mapScope(emlConfig)
+	if err != nil {
+		return nil, ContextualError(err, "mapScope")
+	}
 	secretHex, err := key.SecretHex()
 	if err != nil {
 		return nil, ContextualError(err, "key.SecretHex")
@@ -57,10 +59,8 @@ func mapScope(emlConfig *Config) ([]int, error) {
 		}
 		scope[i] = num
 	}
-	num, err := strconv.Atoi(emlConfig.DisbursementCompanyId)
-	if err == nil {
+	if num, err := strconv.Atoi(emlConfig.DisbursementCompanyId); err == nil {
 		scope = append(scope, num)
-		log.Printf("error converting disbursement company ID to int: %s", emlConfig.DisbursementCompanyId)
 	}
 	sort.Ints(scope)
 	return scope, nil
@@ -0,0 +1,314 @@
+package eml
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OutcomeProcessed = "processed"
+	OutcomeIgnored   = "ignored"
+	OutcomeRejected  = "rejected"
+	OutcomeFailed    = "failed"
+)
+
+// MetricsRecorder receives measurements from the client, token refresh, webhook, handler and undeliverable processing
+type MetricsRecorder interface {
+	// status is the HTTP status, or 0 when no response was received
+	ObserveRequest(endpoint, method string, status int, duration time.Duration)
+	ObserveTokenRefresh(success bool, duration time.Duration)
+	ObserveWebhook(messageType, outcome string, status int, duration time.Duration)
+	// Recorded by the Instrument middleware for each call of the wrapped TransactionHandler
+	ObserveHandler(messageType, outcome string, duration time.Duration)
+	ObserveUndeliverable(hookId string, handled, failed int, duration time.Duration)
+	// Messages seen but not dismissed by the last undeliverable run
+	SetUndeliverableBacklog(hookId string, backlog int)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveRequest(string, string, int, time.Duration)    {}
+func (nopMetrics) ObserveTokenRefresh(bool, time.Duration)              {}
+func (nopMetrics) ObserveWebhook(string, string, int, time.Duration)    {}
+func (nopMetrics) ObserveHandler(string, string, time.Duration)         {}
+func (nopMetrics) ObserveUndeliverable(string, int, int, time.Duration) {}
+func (nopMetrics) SetUndeliverableBacklog(string, int)                  {}
+
+func metricsOrNop(m MetricsRecorder) MetricsRecorder {
+	if m == nil {
+		return nopMetrics{}
+	}
+	return m
+}
+
+var DefaultDurationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics is an in-process MetricsRecorder, serve it with Handler for Prometheus to scrape
+type Metrics struct {
+	requests          *counterVec
+	requestDuration   *histogramVec
+	tokenRefreshes    *counterVec
+	tokenDuration     *histogramVec
+	webhooks          *counterVec
+	webhookDuration   *histogramVec
+	handlers          *counterVec
+	handlerDuration   *histogramVec
+	undeliverable     *counterVec
+	undeliverableRuns *histogramVec
+	backlog           *gaugeVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:          newCounterVec("eml_client_requests_total", "EML API requests by endpoint, method and status.", "endpoint", "method", "status"),
+		requestDuration:   newHistogramVec("eml_client_request_duration_seconds", "EML API request latency.", DefaultDurationBuckets, "endpoint", "method"),
+		tokenRefreshes:    newCounterVec("eml_token_refreshes_total", "EML access token refreshes by result.", "result"),
+		tokenDuration:     newHistogramVec("eml_token_refresh_duration_seconds", "EML access token refresh latency.", DefaultDurationBuckets),
+		webhooks:          newCounterVec("eml_webhook_notifications_total", "EML webhook notifications by type, outcome and response status.", "type", "outcome", "status"),
+		webhookDuration:   newHistogramVec("eml_webhook_duration_seconds", "EML webhook handling latency.", DefaultDurationBuckets, "type"),
+		handlers:          newCounterVec("eml_handler_calls_total", "Transaction handler calls by message type and outcome.", "type", "outcome"),
+		handlerDuration:   newHistogramVec("eml_handler_duration_seconds", "Transaction handler latency.", DefaultDurationBuckets, "type"),
+		undeliverable:     newCounterVec("eml_undeliverable_messages_total", "Undeliverable messages processed by hook and result.", "hook", "result"),
+		undeliverableRuns: newHistogramVec("eml_undeliverable_run_duration_seconds", "Time taken to drain undeliverable messages.", DefaultDurationBuckets, "hook"),
+		backlog:           newGaugeVec("eml_undeliverable_backlog", "Undeliverable messages left after the last run.", "hook"),
+	}
+}
+
+func (m *Metrics) ObserveRequest(endpoint, method string, status int, duration time.Duration) {
+	statusLabel := "error"
+	if status > 0 {
+		statusLabel = strconv.Itoa(status)
+	}
+	m.requests.inc(1, endpoint, method, statusLabel)
+	m.requestDuration.observe(duration.Seconds(), endpoint, method)
+}
+
+func (m *Metrics) ObserveTokenRefresh(success bool, duration time.Duration) {
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	m.tokenRefreshes.inc(1, result)
+	m.tokenDuration.observe(duration.Seconds())
+}
+
+func (m *Metrics) ObserveWebhook(messageType, outcome string, status int, duration time.Duration) {
+	m.webhooks.inc(1, messageType, outcome, strconv.Itoa(status))
+	m.webhookDuration.observe(duration.Seconds(), messageType)
+}
+
+func (m *Metrics) ObserveHandler(messageType, outcome string, duration time.Duration) {
+	m.handlers.inc(1, messageType, outcome)
+	m.handlerDuration.observe(duration.Seconds(), messageType)
+}
+
+func (m *Metrics) ObserveUndeliverable(hookId string, handled, failed int, duration time.Duration) {
+	m.undeliverable.inc(float64(handled), hookId, "handled")
+	m.undeliverable.inc(float64(failed), hookId, "failed")
+	m.undeliverableRuns.observe(duration.Seconds(), hookId)
+}
+
+func (m *Metrics) SetUndeliverableBacklog(hookId string, backlog int) {
+	m.backlog.set(float64(backlog), hookId)
+}
+
+// Handler serves all metrics in the Prometheus text exposition format
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentType, "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		m.WriteText(w)
+	})
+}
+
+func (m *Metrics) WriteText(w io.Writer) {
+	var sb strings.Builder
+	for _, c := range []collector{m.requests, m.requestDuration, m.tokenRefreshes, m.tokenDuration, m.webhooks, m.webhookDuration, m.handlers, m.handlerDuration, m.undeliverable, m.undeliverableRuns, m.backlog} {
+		c.writeText(&sb)
+	}
+	_, _ = w.Write([]byte(sb.String()))
+}
+
+type collector interface {
+	writeText(sb *strings.Builder)
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *metricDesc) header(sb *strings.Builder, kind string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, kind)
+}
+
+func (d *metricDesc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, n, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+type counterVec struct {
+	metricDesc
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{metricDesc: metricDesc{name: name, help: help, labels: labels}, samples: map[string]*sample{}}
+}
+
+func (c *counterVec) inc(v float64, labels ...string) {
+	k := c.key(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.samples[k]
+	if !ok {
+		s = &sample{labels: labels}
+		c.samples[k] = s
+	}
+	s.value += v
+}
+
+func (c *counterVec) writeText(sb *strings.Builder) {
+	c.header(sb, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range sortedKeys(c.samples) {
+		s := c.samples[k]
+		fmt.Fprintf(sb, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels), formatFloat(s.value))
+	}
+}
+
+type gaugeVec struct {
+	*counterVec
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{newCounterVec(name, help, labels...)}
+}
+
+func (g *gaugeVec) set(v float64, labels ...string) {
+	k := g.key(labels)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.samples[k] = &sample{labels: labels, value: v}
+}
+
+func (g *gaugeVec) writeText(sb *strings.Builder) {
+	g.header(sb, "gauge")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, k := range sortedKeys(g.samples) {
+		s := g.samples[k]
+		fmt.Fprintf(sb, "%s%s %s\n", g.name, formatLabels(g.labels, s.labels), formatFloat(s.value))
+	}
+}
+
+type histogramSample struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	metricDesc
+	buckets []float64
+	mu      sync.Mutex
+	samples map[string]*histogramSample
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &histogramVec{metricDesc: metricDesc{name: name, help: help, labels: labels}, buckets: b, samples: map[string]*histogramSample{}}
+}
+
+func (h *histogramVec) observe(v float64, labels ...string) {
+	k := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.samples[k]
+	if !ok {
+		s = &histogramSample{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.samples[k] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) writeText(sb *strings.Builder) {
+	h.header(sb, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range sortedKeys(h.samples) {
+		s := h.samples[k]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(sb, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(sb, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch t := m.(type) {
+	case map[string]*sample:
+		for k := range t {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramSample:
+		for k := range t {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,63 @@
+package eml
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_Handler(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveRequest("/3.0/accounts/{id}", "GET", 200, 30*time.Millisecond)
+	m.ObserveRequest("/3.0/accounts/{id}", "GET", 0, time.Second)
+	m.ObserveTokenRefresh(true, 20*time.Millisecond)
+	m.ObserveWebhook(TxnTypeTransaction, OutcomeRejected, 401, time.Millisecond)
+	m.SetUndeliverableBacklog("hook\"1", 4)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+	assert.Contains(t, body, "# TYPE eml_client_requests_total counter\n")
+	assert.Contains(t, body, `eml_client_requests_total{endpoint="/3.0/accounts/{id}",method="GET",status="200"} 1`)
+	assert.Contains(t, body, `eml_client_requests_total{endpoint="/3.0/accounts/{id}",method="GET",status="error"} 1`)
+	assert.Contains(t, body, `eml_client_request_duration_seconds_bucket{endpoint="/3.0/accounts/{id}",method="GET",le="0.05"} 1`)
+	assert.Contains(t, body, `eml_client_request_duration_seconds_bucket{endpoint="/3.0/accounts/{id}",method="GET",le="+Inf"} 2`)
+	assert.Contains(t, body, `eml_client_request_duration_seconds_count{endpoint="/3.0/accounts/{id}",method="GET"} 2`)
+	assert.Contains(t, body, `eml_token_refreshes_total{result="success"} 1`)
+	assert.Contains(t, body, `eml_token_refresh_duration_seconds_bucket{le="0.025"} 1`)
+	assert.Contains(t, body, `eml_webhook_notifications_total{type="transaction",outcome="rejected",status="401"} 1`)
+	assert.Contains(t, body, `eml_undeliverable_backlog{hook="hook\"1"} 4`)
+}
+
+// Store requests are labelled by their path template rather than the expanded URL
+func Test_emlStore_Metrics(t *testing.T) {
+	m := NewMetrics()
+	e := &Settings{EmlRestId: clientId, EmlHostUrl: baseUrl, Metrics: m}
+	store := &emlStore{_restSecret: clientSecret, _env: e}
+	store.lazyInit(ctx)
+
+	httpmock.ActivateNonDefault(store._lazyClient.GetClient())
+	defer httpmock.DeactivateAndReset()
+	mockTokenResponse(t)
+	httpmock.RegisterResponder("GET", "https://eml.com/3.0/accounts/eaid/status", httpmock.NewJsonResponderOrPanic(200, AccountSummary{}))
+	httpmock.RegisterResponder("GET", "https://eml.com/3.0/accounts/missing/status", httpmock.NewJsonResponderOrPanic(404, ErrorModel{Code: "not_found"}))
+
+	_, err := store.GetSummary(ctx, "eaid")
+	assert.NoError(t, err)
+	_, err = store.GetSummary(ctx, "missing")
+	assert.True(t, IsNotFoundError(err), "expected not found, got %v", err)
+
+	rec := httptest.NewRecorder()
+	m.WriteText(rec)
+	body := rec.Body.String()
+	assert.Contains(t, body, `eml_client_requests_total{endpoint="/3.0/accounts/{id}/status",method="GET",status="200"} 1`)
+	assert.Contains(t, body, `eml_client_requests_total{endpoint="/3.0/accounts/{id}/status",method="GET",status="404"} 1`)
+	assert.Contains(t, body, `eml_token_refreshes_total{result="success"} 1`)
+}
@@ -0,0 +1,164 @@
+package eml
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a TransactionHandler with extra behaviour
+type Middleware func(TransactionHandler) TransactionHandler
+
+// Chain wraps h in middleware, the first being outermost, e.g.
+// Chain(h, Recover(l), Logging(l), Instrument(m), Retry(3, nil), Timeout(10*time.Second))
+func Chain(h TransactionHandler, middleware ...Middleware) TransactionHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Recover turns a panic in the handler into an error, logging its stack, so one bad message can't crash the process
+func Recover(l Logger) Middleware {
+	l = loggerOrNop(l)
+	return func(next TransactionHandler) TransactionHandler {
+		return func(ctx context.Context, message *Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					stack := debug.Stack()
+					if p, ok := r.(*handlerPanic); ok {
+						r, stack = p.value, p.stack
+					}
+					l.Error("Transaction handler panicked", KV("messageId", message.Id), KV("panic", fmt.Sprint(r)), KV("stack", string(stack)))
+					err = fmt.Errorf("handler panicked on message %s: %v", message.Id, r)
+				}
+			}()
+			return next(ctx, message)
+		}
+	}
+}
+
+// A panic from a handler run by Timeout, re-raised on the caller's goroutine with the handler's own stack
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// Returned by Timeout when it gives up on a handler which is still running, done is closed once it returns
+type timeoutError struct {
+	err  error
+	done <-chan struct{}
+}
+
+func (t *timeoutError) Error() string {
+	return t.err.Error()
+}
+
+// Timeout gives each message a deadline. The handler's context is cancelled at the deadline and Timeout returns
+// then even if the handler hasn't. The abandoned call keeps running in the background until the handler notices,
+// so handlers should stop when their context is done. Retry waits for an abandoned call before trying again.
+func Timeout(d time.Duration) Middleware {
+	return func(next TransactionHandler) TransactionHandler {
+		return func(ctx context.Context, message *Message) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			type result struct {
+				err      error
+				panicked *handlerPanic
+			}
+			done := make(chan result, 1)
+			returned := make(chan struct{})
+			go func() {
+				defer close(returned)
+				defer func() {
+					if r := recover(); r != nil {
+						// Captured here, the stack where Recover catches the re-raised panic is Timeout's
+						done <- result{panicked: &handlerPanic{value: r, stack: debug.Stack()}}
+					}
+				}()
+				done <- result{err: next(ctx, message)}
+			}()
+			select {
+			case r := <-done:
+				if r.panicked != nil {
+					// Re-raise on the caller's goroutine so Recover can handle it
+					panic(r.panicked)
+				}
+				return r.err
+			case <-ctx.Done():
+				return &timeoutError{err: ContextualError(ctx.Err(), "handling message %s took over %s", message.Id, d), done: returned}
+			}
+		}
+	}
+}
+
+// Logging logs each message handled, with its duration and any error
+func Logging(l Logger) Middleware {
+	l = loggerOrNop(l)
+	return func(next TransactionHandler) TransactionHandler {
+		return func(ctx context.Context, message *Message) error {
+			start := time.Now()
+			err := next(ctx, message)
+			fields := []Field{KV("messageId", message.Id), KV("type", message.Type), KV("eaid", message.Data.AccountId), KV("duration", time.Since(start).String())}
+			if err != nil {
+				l.Error("Transaction handler failed", append(fields, ErrField(err))...)
+			} else {
+				l.Debug("Transaction handled", fields...)
+			}
+			return err
+		}
+	}
+}
+
+// Instrument records each call's outcome and duration with ObserveHandler
+func Instrument(m MetricsRecorder) Middleware {
+	m = metricsOrNop(m)
+	return func(next TransactionHandler) TransactionHandler {
+		return func(ctx context.Context, message *Message) error {
+			start := time.Now()
+			err := next(ctx, message)
+			outcome := OutcomeProcessed
+			if err != nil {
+				outcome = OutcomeFailed
+			}
+			m.ObserveHandler(message.Type, outcome, time.Since(start))
+			return err
+		}
+	}
+}
+
+// Retry calls the handler up to attempts times while it fails with a server error, waiting backoff(retry) before
+// each retry, 1s doubling when backoff is nil. Client errors such as validation failures aren't retried. After a
+// Timeout it also waits for the abandoned call to return.
+func Retry(attempts int, backoff func(retry int) time.Duration) Middleware {
+	if backoff == nil {
+		backoff = exponentialBackoff
+	}
+	return func(next TransactionHandler) TransactionHandler {
+		return func(ctx context.Context, message *Message) error {
+			var err error
+			for attempt := 1; ; attempt++ {
+				err = next(ctx, message)
+				if err == nil || attempt >= attempts || errorStatus(err) < 500 {
+					return err
+				}
+				if t, ok := err.(*timeoutError); ok {
+					// Never handle the same message twice at once
+					select {
+					case <-ctx.Done():
+						return err
+					case <-t.done:
+					}
+				}
+				timer := time.NewTimer(backoff(attempt))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return err
+				case <-timer.C:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package eml
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next TransactionHandler) TransactionHandler {
+			return func(ctx context.Context, m *Message) error {
+				order = append(order, name)
+				return next(ctx, m)
+			}
+		}
+	}
+	h := Chain(func(ctx context.Context, m *Message) error {
+		order = append(order, "handler")
+		return nil
+	}, trace("outer"), trace("inner"))
+
+	assert.NoError(t, h(ctx, &Message{}))
+	assert.Equal(t, []string{"outer", "inner", "handler"}, order)
+}
+
+func TestRecover(t *testing.T) {
+	l := &recordingLogger{}
+	h := Chain(func(ctx context.Context, m *Message) error {
+		panic("boom")
+	}, Recover(l), Timeout(time.Second))
+
+	err := h(ctx, &Message{Id: "m1"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "boom")
+	assert.Len(t, l.entries, 1)
+}
+
+func panickingHandler(ctx context.Context, m *Message) error {
+	panic("boom")
+}
+
+func TestRecover_stackFromTimeout(t *testing.T) {
+	l := &recordingLogger{}
+	h := Chain(panickingHandler, Recover(l), Timeout(time.Second))
+
+	assert.Error(t, h(ctx, &Message{Id: "m1"}))
+	var stack string
+	for _, f := range l.entries[0].fields {
+		if f.Key == "stack" {
+			stack = f.Value.(string)
+		}
+	}
+	assert.Contains(t, stack, "panickingHandler", "the stack is the handler's, not Timeout's")
+}
+
+func TestRetry_waitsForTimedOutCall(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning, calls := 0, 0, 0
+	h := Chain(func(ctx context.Context, m *Message) error {
+		mu.Lock()
+		calls++
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return ctx.Err()
+	}, Retry(2, func(int) time.Duration { return 0 }), Timeout(5*time.Millisecond))
+
+	assert.Error(t, h(ctx, &Message{Id: "m1"}))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1, maxRunning, "a retry doesn't start while the timed out call is still running")
+}
+
+func TestTimeout(t *testing.T) {
+	h := Chain(func(ctx context.Context, m *Message) error {
+		<-ctx.Done()
+		time.Sleep(time.Second)
+		return nil
+	}, Timeout(10*time.Millisecond))
+
+	start := time.Now()
+	err := h(ctx, &Message{Id: "m1"})
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second, "returns at the deadline")
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	noWait := func(int) time.Duration { return 0 }
+	h := Chain(func(ctx context.Context, m *Message) error {
+		calls++
+		if calls < 3 {
+			return errors.New("failed")
+		}
+		return nil
+	}, Retry(3, noWait))
+	assert.NoError(t, h(ctx, &Message{}))
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	h = Chain(func(ctx context.Context, m *Message) error {
+		calls++
+		return BadError(ErrorValidation, errors.New("bad"))
+	}, Retry(3, noWait))
+	assert.Equal(t, http.StatusBadRequest, errorStatus(h(ctx, &Message{})))
+	assert.Equal(t, 1, calls, "client errors aren't retried")
+}
+
+func TestInstrument(t *testing.T) {
+	m := NewMetrics()
+	h := Chain(func(ctx context.Context, m *Message) error { return nil }, Instrument(m))
+	assert.NoError(t, h(ctx, &Message{Type: TxnTypeTransaction}))
+
+	var sb strings.Builder
+	m.WriteText(&sb)
+	assert.Contains(t, sb.String(), `eml_handler_calls_total{type="transaction",outcome="processed"} 1`)
+}
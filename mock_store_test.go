@@ -0,0 +1,107 @@
+package eml
+
+import (
+	"context"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockStore struct {
+	mock.Mock
+}
+
+func (m *MockStore) CreateAccount(ctx context.Context, request *CreateAccountRequest) (*AccountSummary, error) {
+	args := m.Called(ctx, request)
+	summary, _ := args.Get(0).(*AccountSummary)
+	return summary, args.Error(1)
+}
+
+func (m *MockStore) GetAccount(ctx context.Context, eaid string, flags ...GetAccountFlag) (*AccountInfo, error) {
+	args := m.Called(ctx, eaid, flags)
+	info, _ := args.Get(0).(*AccountInfo)
+	return info, args.Error(1)
+}
+
+func (m *MockStore) GetSummary(ctx context.Context, eaid string) (*AccountSummary, error) {
+	args := m.Called(ctx, eaid)
+	summary, _ := args.Get(0).(*AccountSummary)
+	return summary, args.Error(1)
+}
+
+func (m *MockStore) GetTransactions(ctx context.Context, eaid string, pageSize int, cursor string, startDate *time.Time, endDate *time.Time) (*TransactionsPage, error) {
+	args := m.Called(ctx, eaid, pageSize, cursor, startDate, endDate)
+	page, _ := args.Get(0).(*TransactionsPage)
+	return page, args.Error(1)
+}
+
+func (m *MockStore) UpdateStatus(ctx context.Context, eaid string, status CardStatus) error {
+	return m.Called(ctx, eaid, status).Error(0)
+}
+
+func (m *MockStore) UpdatePlasticEnabled(ctx context.Context, eaid string, enabled bool) error {
+	return m.Called(ctx, eaid, enabled).Error(0)
+}
+
+func (m *MockStore) UpdateRegistration(ctx context.Context, eaid string, info RegistrationInfo) error {
+	return m.Called(ctx, eaid, info).Error(0)
+}
+
+func (m *MockStore) Transfer(ctx context.Context, eaid string, request *TransferRequest) error {
+	return m.Called(ctx, eaid, request).Error(0)
+}
+
+func (m *MockStore) AddHook(ctx context.Context, model *HookRequest) (string, error) {
+	args := m.Called(ctx, model)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockStore) GetHooks(ctx context.Context) (*HookPage, error) {
+	args := m.Called(ctx)
+	page, _ := args.Get(0).(*HookPage)
+	return page, args.Error(1)
+}
+
+func (m *MockStore) GetHook(ctx context.Context, hookId string) (*Hook, error) {
+	args := m.Called(ctx, hookId)
+	hook, _ := args.Get(0).(*Hook)
+	return hook, args.Error(1)
+}
+
+func (m *MockStore) DeleteHook(ctx context.Context, hookId string) error {
+	return m.Called(ctx, hookId).Error(0)
+}
+
+func (m *MockStore) UpdateHookScope(ctx context.Context, hookId string, scope []int) error {
+	return m.Called(ctx, hookId, scope).Error(0)
+}
+
+func (m *MockStore) UpdateHook(ctx context.Context, hookId string, request *HookRequest) error {
+	return m.Called(ctx, hookId, request).Error(0)
+}
+
+func (m *MockStore) GetUndeliverable(ctx context.Context, hookId string, pageSize int, pageNumber int) (*MessagePage, error) {
+	args := m.Called(ctx, hookId, pageSize, pageNumber)
+	page, _ := args.Get(0).(*MessagePage)
+	return page, args.Error(1)
+}
+
+func (m *MockStore) DismissUndeliverable(ctx context.Context, hookId string, messageIds []string) error {
+	return m.Called(ctx, hookId, messageIds).Error(0)
+}
+
+func (m *MockStore) Authenticate(ctx context.Context, eaid string, req AuthenticateRequest) (*AuthenticateResponse, error) {
+	args := m.Called(ctx, eaid, req)
+	resp, _ := args.Get(0).(*AuthenticateResponse)
+	return resp, args.Error(1)
+}
+
+func (m *MockStore) Initiate(ctx context.Context, eaid string, req InitiateRequest) (*InitiateResponse, error) {
+	args := m.Called(ctx, eaid, req)
+	resp, _ := args.Get(0).(*InitiateResponse)
+	return resp, args.Error(1)
+}
+
+func (m *MockStore) Activate(ctx context.Context, eaid string, req ActivateRequest) error {
+	return m.Called(ctx, eaid, req).Error(0)
+}
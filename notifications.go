@@ -1,82 +1,182 @@
 package eml
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
+	"net/http"
 	"strings"
+	"time"
 )
 
 type TransactionHandler func(ctx context.Context, message *Message) error
 
+// MessageHandlers handles each message type, e.g. TxnTypeTransaction
+type MessageHandlers map[TransactionType]TransactionHandler
+
 // Webhook endpoint
 func HandleNotification(ctx context.Context, req *Request, res Response, deps Dependencies, h TransactionHandler, uh TransactionHandler) error { //, deps *app.Dependencies
-	messageType, version, err := GetEmlMessageSpec(req)
-	log.Printf("Handling EML Notification %s@%s\n", messageType, version)
-	if err != nil {
-		return err
-	}
-	if messageType != TxnTypeTransaction && messageType != TxnTypeUndeliverableAlert {
-		log.Println("Acknowledging ", messageType, " we don't care about")
-		var message IdModel
+	return HandleNotificationByType(ctx, req, res, deps, defaultMessageHandlers(&deps, h, uh))
+}
 
-		if err := json.NewDecoder(req.Body).Decode(&message); err != nil {
-			return BadError(ErrorParsingBody, ContextualError(err, "json.Decode"))
+// Handles transaction messages with h, pings by logging them and undeliverable alerts with uh, or by processing the
+// undeliverable messages with h when uh is nil
+func defaultMessageHandlers(deps *Dependencies, h TransactionHandler, uh TransactionHandler) MessageHandlers {
+	if uh == nil {
+		p := deps.undeliverableProcessor(h)
+		uh = func(ctx context.Context, message *Message) error {
+			return p.processAllUndeliverableMessages(ctx, message.HookId, message.Id)
 		}
+	}
+	return MessageHandlers{
+		TxnTypeTransaction:        h,
+		TxnTypeUndeliverableAlert: uh,
+		TxnTypePing:               pingHandler(deps.logger()),
+	}
+}
 
-		res.JsonOk(message)
+// Acknowledges pings, which EML sends to check connectivity
+func pingHandler(l Logger) TransactionHandler {
+	return func(ctx context.Context, message *Message) error {
+		l.Info("EML ping received", KV("messageId", message.Id), KV("hookId", message.HookId))
 		return nil
 	}
-	if !strings.HasPrefix(version, "1.") {
-		return NotImplementedError(fmt.Errorf("message specification %s version %s is not supported", messageType, version))
+}
+
+// HandleNotificationByType is the webhook endpoint with a handler per message type. The body is size limited and its
+// signature checked before it is decoded, types without a handler are then acknowledged.
+func HandleNotificationByType(ctx context.Context, req *Request, res Response, deps Dependencies, handlers MessageHandlers) (err error) {
+	l := deps.logger()
+	span := &Span{Name: SpanWebhook}
+	ctx = deps.tracing().start(ctx, span)
+	outcome := OutcomeProcessed
+	messageType, version, err := GetEmlMessageSpec(req)
+	defer func() {
+		status := errorStatus(err)
+		if err != nil {
+			outcome = OutcomeFailed
+			if status < http.StatusInternalServerError {
+				outcome = OutcomeRejected
+			}
+		}
+		span.MessageType = string(messageType)
+		span.Status = status
+		deps.tracing().end(ctx, span, err)
+		deps.metrics().ObserveWebhook(string(messageType), outcome, status, span.Duration)
+	}()
+	l.Info("Handling EML notification", KV("type", messageType), KV("version", version))
+	if err != nil {
+		return err
+	}
+	if err := req.CheckJsonContentType(); err != nil {
+		return err
 	}
-	//if emlConfig == nil || emlConfig.NotificationHookId == "" {
-	//	emlConfig, err = deps.Data.GetEmlConfig(ctx)
-	//	if err != nil {
-	//		return ContextualError(err, "deps.Data.GetEmlConfig")
-	//	}
-	//}
-	var message Message
-	var buf bytes.Buffer
-	if err := req.UnmarshalJsonAndCopy(&message, &buf); err != nil {
+	if deps.Config.NotificationHookId == "" && deps.Data != nil {
+		// Set up by another process, or before a restart. Loaded into a copy as Config is shared between requests.
+		state, err := deps.Data.LoadHookState(ctx)
+		if err != nil {
+			return ContextualError(err, "deps.Data.LoadHookState")
+		}
+		config := *deps.Config
+		config.ApplyHookState(state)
+		deps.Config = &config
+	}
+	body, err := req.ReadBody(deps.Config.maxNotificationBytes())
+	if err != nil {
 		return err
 	}
+	if err := req.VerifyHmacSignature(deps.Config.keyLookup(), body); err != nil {
+		l.Warn("EML notification signature check failed", KV("type", messageType), KV("body", string(body)), ErrField(err))
+		return NewHttpError(http.StatusUnauthorized, ErrorInvalidSignature, ContextualError(err, "req.VerifyHmacSignature"))
+	}
+	decode := deps.decoders().Decoder(messageType, version)
+	if decode == nil {
+		if deps.decoders().Policy() != AcknowledgeUnknownVersion {
+			return NotImplementedError(fmt.Errorf("message specification %s version %s is not supported", messageType, version))
+		}
+		outcome = OutcomeIgnored
+		return acknowledgeUnknownVersion(ctx, req, res, &deps, messageType, version, body)
+	}
+	decoded, err := decode(body)
+	if err != nil {
+		return BadError(ErrorParsingBody, ContextualError(err, "decode %s@%s", messageType, version))
+	}
+	message := *decoded
+	ctx = traceMessage(ctx, span, &message)
+	archiveNotification(ctx, req, &deps, messageType, &message, body)
+
 	if message.HookId != deps.Config.NotificationHookId {
 		// Would happen on dev/staging using same EML env and companies
-		log.Println("Acknowledging", messageType, "meant for different hook", message.HookId, ", not ours:", deps.Config.NotificationHookId)
+		l.Info("Acknowledging notification meant for different hook", KV("type", messageType), KV("hookId", message.HookId), KV("ourHookId", deps.Config.NotificationHookId))
+		outcome = OutcomeIgnored
 		res.JsonOk(IdModel{Id: message.Id})
 		return nil
 	}
-
-	// Temporarily log entire payload
-	var buf2 bytes.Buffer
-	sb := new(strings.Builder)
-	_, _ = io.Copy(sb, io.TeeReader(&buf, &buf2))
-	fmt.Println(sb.String())
-	buf = buf2
-	// end temporary logging
-
-	if body, err := req.CheckHmacSignature(deps.Config.HmacKey, &buf); err != nil {
-		log.Println(body.(*bytes.Buffer).String())
-		return UnauthorizedError(ContextualError(err, "req.CheckHmacSignature"))
+	finish, handled, err := deps.ReplayProtection.claim(ctx, &message)
+	if err != nil {
+		l.Warn("EML notification rejected as a replay", KV("messageId", message.Id), KV("timestamp", message.Timestamp), ErrField(err))
+		return err
 	}
-	if messageType == TxnTypeUndeliverableAlert {
-		if uh != nil {
-			err = uh(ctx, &message)
-		} else {
-			err = processAllUndeliverableMessages(ctx, message.HookId, message.Id, deps.Store, h)
-		}
+	if handled {
+		// Most likely EML retrying after our response was lost, acknowledge it so it isn't redelivered as undeliverable
+		l.Info("Acknowledging EML notification already handled", KV("messageId", message.Id), KV("timestamp", message.Timestamp))
+		outcome = OutcomeIgnored
+		res.JsonOk(IdModel{Id: message.Id})
+		return nil
+	}
+	handler := handlers[messageType]
+	if handler == nil {
+		l.Info("Acknowledging notification we don't handle", KV("type", messageType), KV("messageId", message.Id))
+		outcome = OutcomeIgnored
 	} else {
-		err = h(ctx, &message)
+		err = Recover(l)(handler)(ctx, &message)
+	}
+	if finishErr := finish(ctx, err); finishErr != nil {
+		l.Error("Failed to record EML notification nonce", KV("messageId", message.Id), ErrField(finishErr))
 	}
 	return res.HandleJsonOk(IdModel{Id: message.Id}, err)
 }
 
+// Archives a verified notification when there is an archive, failures are logged so the message is still handled
+func archiveNotification(ctx context.Context, req *Request, deps *Dependencies, messageType TransactionType, message *Message, body []byte) {
+	if deps.Archive == nil {
+		return
+	}
+	if err := deps.Archive.Store(ctx, newArchivedMessage(req, messageType, message, body, deps.Redactor, time.Now())); err != nil {
+		deps.logger().Error("Failed to archive EML notification", KV("messageId", message.Id), ErrField(err))
+	}
+}
+
+// Archives and acknowledges a message version we can't decode, reading only the fields every version has
+func acknowledgeUnknownVersion(ctx context.Context, req *Request, res Response, deps *Dependencies, messageType TransactionType, version string, body []byte) error {
+	var message Message
+	var envelope struct {
+		Id     string `json:"id"`
+		HookId string `json:"hook_id"`
+	}
+	_ = json.Unmarshal(body, &envelope)
+	message.Id, message.HookId = envelope.Id, envelope.HookId
+	deps.logger().Warn("Acknowledging notification with unsupported version", KV("type", messageType), KV("version", version), KV("messageId", message.Id))
+	archiveNotification(ctx, req, deps, messageType, &message, body)
+	res.JsonOk(IdModel{Id: message.Id})
+	return nil
+}
+
+// Adds the message to span, using the message ID as the correlation ID for any EML calls made while handling it
+func traceMessage(ctx context.Context, span *Span, message *Message) context.Context {
+	span.MessageId = message.Id
+	span.HookId = message.HookId
+	span.Eaid = message.Data.AccountId
+	span.LogicalTransactionId = message.Data.LogicalTransactionId
+	if span.CorrelationId == "" {
+		span.CorrelationId = message.Id
+		ctx = WithCorrelationId(ctx, message.Id)
+	}
+	return ctx
+}
+
 func GetEmlMessageSpec(r *Request) (messageType TransactionType, version string, err error) {
 	spec := r.Header.Get(headerEmlSpecification)
 	if spec == "" || !strings.Contains(spec, "@") {
@@ -93,6 +193,31 @@ type Config struct {
 	DisbursementCompanyId string
 	NotificationHookId    string
 	HmacKey               *Key
+	// When set, webhooks are verified against the key matching their key ID instead of HmacKey
+	HmacKeys *KeyRing
+	// Larger webhook bodies are rejected, 1MB when zero
+	MaxNotificationBytes int64
+	// The key from ApplyHookState, looked up alongside HmacKeys
+	hookKey *Key
+}
+
+const defaultMaxNotificationBytes = 1 << 20
+
+func (c *Config) maxNotificationBytes() int64 {
+	if c.MaxNotificationBytes > 0 {
+		return c.MaxNotificationBytes
+	}
+	return defaultMaxNotificationBytes
+}
+
+func (c *Config) keyLookup() KeyLookup {
+	if c.HmacKeys != nil {
+		if c.hookKey != nil {
+			return ringWithKey{ring: c.HmacKeys, key: c.hookKey}
+		}
+		return c.HmacKeys
+	}
+	return singleKey{c.HmacKey}
 }
 
 type ProductCompany struct {
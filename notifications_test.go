@@ -0,0 +1,136 @@
+package eml
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testHmacKey = &Key{Id: "key1", Secret: "c2VjcmV0"}
+
+func testTxnMessage() *Message {
+	return &Message{
+		Id:     "m1",
+		HookId: "hook1",
+		Type:   TxnTypeTransaction,
+		Data:   MessageData{AccountId: "eaid1", LogicalTransactionId: 7},
+	}
+}
+
+// Delivers m straight to h without a server
+func serveMessage(c *WebhookTestClient, h http.Handler, m *Message) (*httptest.ResponseRecorder, error) {
+	req, err := c.NewRequest(context.Background(), m)
+	if err != nil {
+		return nil, err
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec, nil
+}
+
+func TestSignMessage(t *testing.T) {
+	auth, err := SignMessage(testHmacKey, []byte(`{"id":"m1"}`))
+	assert.NoError(t, err)
+
+	req, _ := NewRequest(&http.Request{Header: http.Header{headerActualAuth: {auth}}})
+	_, err = req.CheckHmacSignature(testHmacKey, strings.NewReader(`{"id":"m1"}`))
+	assert.NoError(t, err)
+	_, err = req.CheckHmacSignature(testHmacKey, strings.NewReader(`{"id":"m2"}`))
+	assert.Error(t, err)
+}
+
+func TestNewWebhookHandler(t *testing.T) {
+	var handled []string
+	deps := &Dependencies{Config: &Config{NotificationHookId: "hook1", HmacKey: testHmacKey}}
+	handler := NewWebhookHandler(deps, WithTransactionHandler(func(ctx context.Context, m *Message) error {
+		handled = append(handled, m.Id)
+		return nil
+	}))
+	client := NewWebhookTestClient(testHmacKey, "http://localhost/eml")
+
+	rec, err := serveMessage(client, handler, testTxnMessage())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"m1"}, handled)
+
+	other := testTxnMessage()
+	other.Id, other.HookId = "m2", "hook2"
+	rec, _ = serveMessage(client, handler, other)
+	assert.Equal(t, http.StatusOK, rec.Code, "messages for other hooks are acknowledged")
+	assert.Equal(t, []string{"m1"}, handled)
+
+	wrongKey := NewWebhookTestClient(&Key{Id: "key1", Secret: "b3RoZXI="}, "http://localhost/eml")
+	rec, _ = serveMessage(wrongKey, handler, testTxnMessage())
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, []string{"m1"}, handled)
+}
+
+func TestNewWebhookHandler_messageTypes(t *testing.T) {
+	var handled []string
+	deps := &Dependencies{Config: &Config{NotificationHookId: "hook1", HmacKey: testHmacKey}}
+	handler := NewWebhookHandler(deps,
+		WithTransactionHandler(func(ctx context.Context, m *Message) error { return nil }),
+		WithMessageHandler("card_event", func(ctx context.Context, m *Message) error {
+			handled = append(handled, m.Id)
+			return nil
+		}))
+	client := NewWebhookTestClient(testHmacKey, "http://localhost/eml")
+
+	rec, _ := serveMessage(client, handler, &Message{Id: "p1", HookId: "hook1", Type: TxnTypePing})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec, _ = serveMessage(client, handler, &Message{Id: "c1", HookId: "hook1", Type: "card_event"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec, _ = serveMessage(client, handler, &Message{Id: "o1", HookId: "hook1", Type: "other"})
+	assert.Equal(t, http.StatusOK, rec.Code, "types without a handler are acknowledged")
+	assert.Equal(t, []string{"c1"}, handled)
+
+	wrongKey := NewWebhookTestClient(&Key{Id: "key1", Secret: "b3RoZXI="}, "http://localhost/eml")
+	for _, messageType := range []string{TxnTypePing, "card_event", "other"} {
+		rec, _ = serveMessage(wrongKey, handler, &Message{Id: "x1", HookId: "hook1", Type: messageType})
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, messageType)
+	}
+	assert.Equal(t, []string{"c1"}, handled)
+}
+
+func TestNewWebhookHandler_rejects(t *testing.T) {
+	deps := &Dependencies{Config: &Config{NotificationHookId: "hook1", HmacKey: testHmacKey, MaxNotificationBytes: 64}}
+	handler := NewWebhookHandler(deps, WithTransactionHandler(func(ctx context.Context, m *Message) error {
+		t.Error("rejected messages shouldn't be handled")
+		return nil
+	}))
+	client := NewWebhookTestClient(testHmacKey, "http://localhost/eml")
+	serve := func(req *http.Request) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	req, _ := client.NewRawRequest(ctx, "transaction@1.0.0", []byte(`{"id":"`+strings.Repeat("x", 64)+`"}`))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve(req))
+
+	req, _ = client.NewRawRequest(ctx, "transaction@1.0.0", []byte(`{"id":"m1"}`))
+	req.Header.Set(headerContentType, "text/plain")
+	assert.Equal(t, http.StatusUnsupportedMediaType, serve(req))
+
+	req, _ = client.NewRawRequest(ctx, "transaction@1.0.0", []byte(`{"id":"m1"}`))
+	req.Header.Del(headerActualAuth)
+	assert.Equal(t, http.StatusUnauthorized, serve(req))
+
+	req, _ = client.NewRawRequest(ctx, "transaction@1.0.0", []byte(`{"id":`))
+	assert.Equal(t, http.StatusBadRequest, serve(req), "bodies are only decoded once the signature is checked")
+}
+
+func TestVerifyHmacSignature(t *testing.T) {
+	auth, _ := SignMessage(testHmacKey, []byte(`{"id":"m1"}`))
+	req, _ := NewRequest(&http.Request{Header: http.Header{headerActualAuth: {auth}}})
+	assert.NoError(t, req.VerifyHmacSignature(singleKey{testHmacKey}, []byte(`{"id":"m1"}`)))
+
+	err := req.VerifyHmacSignature(singleKey{testHmacKey}, []byte(`{"id":"m2"}`))
+	expected, _ := SignMessage(testHmacKey, []byte(`{"id":"m2"}`))
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), strings.Split(expected, ";")[1], "the expected MAC mustn't leak")
+}
@@ -0,0 +1,157 @@
+package eml
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollInterval = 5 * time.Minute
+	defaultLeaseTTL     = time.Minute
+)
+
+// Lease lets one instance at a time drain a hook's undeliverable messages
+type Lease interface {
+	// Acquire takes or renews the named lease for holder until ttl has passed, false when another holder has it
+	Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	// Release gives up the lease if holder has it
+	Release(ctx context.Context, name, holder string) error
+}
+
+type memoryLease struct {
+	holder  string
+	expires time.Time
+}
+
+// MemoryLease only coordinates within one process, implement Lease over shared storage for several instances
+type MemoryLease struct {
+	mu     sync.Mutex
+	leases map[string]memoryLease
+	now    func() time.Time
+}
+
+func NewMemoryLease() *MemoryLease {
+	return &MemoryLease{leases: map[string]memoryLease{}, now: time.Now}
+}
+
+func (m *MemoryLease) Acquire(_ context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if l, ok := m.leases[name]; ok && l.holder != holder && l.expires.After(now) {
+		return false, nil
+	}
+	m.leases[name] = memoryLease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryLease) Release(_ context.Context, name, holder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.leases[name]; ok && l.holder == holder {
+		delete(m.leases, name)
+	}
+	return nil
+}
+
+// Takes the hook's lease when one is configured and renews it until release is called. ok is false when another
+// instance holds it. The returned context is cancelled if the lease is lost.
+func (p *undeliverableProcessor) takeLease(ctx context.Context, hookId string) (leaseCtx context.Context, release func(), ok bool, err error) {
+	if p.options == nil || p.options.Lease == nil {
+		return ctx, func() {}, true, nil
+	}
+	lease, holder, ttl := p.options.Lease, p.options.leaseHolder(), p.options.leaseTTL()
+	name := "eml-undeliverable-" + hookId
+	if ok, err := lease.Acquire(ctx, name, holder, ttl); err != nil || !ok {
+		return ctx, nil, ok, err
+	}
+	leaseCtx, cancel := context.WithCancel(ctx)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if ok, err := lease.Acquire(leaseCtx, name, holder, ttl); err != nil || !ok {
+					p.log.Error("Lost lease on undelivered messages, stopping", KV("hookId", hookId), ErrField(err))
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return leaseCtx, func() {
+		close(done)
+		// A renewal still in flight could take the lease back after Release
+		<-stopped
+		cancel()
+		if err := lease.Release(ctx, name, holder); err != nil {
+			p.log.Warn("Error releasing lease on undelivered messages", KV("hookId", hookId), ErrField(err))
+		}
+	}, true, nil
+}
+
+// UndeliverablePoller checks the hook for undeliverable messages on an interval, in case an undeliverable_alert was
+// lost, and drains them the same way as the alert would
+type UndeliverablePoller struct {
+	deps      *Dependencies
+	processor *undeliverableProcessor
+	interval  time.Duration
+}
+
+// NewUndeliverablePoller polls every interval, 5 minutes when zero. Set Dependencies.Undeliverable.Lease when
+// several instances run the poller.
+func NewUndeliverablePoller(deps *Dependencies, h TransactionHandler, interval time.Duration) *UndeliverablePoller {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	return &UndeliverablePoller{deps: deps, processor: deps.undeliverableProcessor(h), interval: interval}
+}
+
+// Run polls until ctx is done, failures are logged and retried on the next poll
+func (p *UndeliverablePoller) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := p.Poll(ctx); err != nil {
+				p.processor.log.Warn("Polling for undelivered messages failed", ErrField(err))
+			}
+		}
+	}
+}
+
+// Poll drains the hook if it has undeliverable messages
+func (p *UndeliverablePoller) Poll(ctx context.Context) error {
+	hookId := p.deps.Config.NotificationHookId
+	if hookId == "" && p.deps.Data != nil {
+		// Set up by another process, or before a restart, the same as for webhooks
+		state, err := p.deps.Data.LoadHookState(ctx)
+		if err != nil {
+			return ContextualError(err, "deps.Data.LoadHookState")
+		}
+		if state != nil {
+			hookId = state.HookId
+		}
+	}
+	if hookId == "" {
+		return nil
+	}
+	hook, err := p.deps.Store.GetHook(ctx, hookId)
+	if err != nil {
+		return ContextualError(err, "emlStore.GetHook")
+	}
+	if hook.LastUndeliverable == "" {
+		return nil
+	}
+	p.processor.log.Info("Poll found undelivered messages", KV("hookId", hook.Id), KV("lastUndeliverable", hook.LastUndeliverable), KV("lastUndeliverableTimestamp", hook.LastUndeliverableTimestamp))
+	return p.processor.processAllUndeliverableMessages(ctx, hook.Id, hook.LastUndeliverable)
+}
@@ -0,0 +1,131 @@
+package eml
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestUndeliverablePoller_Poll(t *testing.T) {
+	store := &MockStore{}
+	lease := NewMemoryLease()
+	deps := &Dependencies{
+		Config:        &Config{NotificationHookId: "hook1"},
+		Store:         store,
+		Undeliverable: &UndeliverableOptions{Lease: lease, LeaseHolder: "instance1"},
+	}
+	var handled []string
+	poller := NewUndeliverablePoller(deps, func(ctx context.Context, m *Message) error {
+		handled = append(handled, m.Id)
+		return nil
+	}, time.Minute)
+	store.On("GetHook", ctx, "hook1").Return(&Hook{Id: "hook1", LastUndeliverable: "1"}, nil)
+	page := &MessagePage{More: false, PageSize: 1, Items: []Message{{Id: "1"}}}
+	store.On("GetUndeliverable", mock.Anything, "hook1", 20, 1).Return(page, nil)
+	store.On("DismissUndeliverable", mock.Anything, "hook1", []string{"1"}).Return(nil)
+
+	ok, _ := lease.Acquire(ctx, "eml-undeliverable-hook1", "instance2", time.Minute)
+	assert.True(t, ok)
+	assert.NoError(t, poller.Poll(ctx))
+	assert.Empty(t, handled, "another instance holds the lease")
+
+	assert.NoError(t, lease.Release(ctx, "eml-undeliverable-hook1", "instance2"))
+	assert.NoError(t, poller.Poll(ctx))
+	assert.Equal(t, []string{"1"}, handled)
+	ok, _ = lease.Acquire(ctx, "eml-undeliverable-hook1", "instance2", time.Minute)
+	assert.True(t, ok, "the lease is released after draining")
+}
+
+func TestUndeliverablePoller_Poll_loadsHookState(t *testing.T) {
+	store := &MockStore{}
+	data := NewMemoryConfigStore()
+	deps := &Dependencies{Config: &Config{}, Store: store, Data: data}
+	poller := NewUndeliverablePoller(deps, func(ctx context.Context, m *Message) error { return nil }, time.Minute)
+	assert.NoError(t, poller.Poll(ctx), "nothing to poll before a hook is set up")
+
+	assert.NoError(t, data.SaveHookState(ctx, &HookState{HookId: "hook1"}))
+	store.On("GetHook", ctx, "hook1").Return(&Hook{Id: "hook1"}, nil)
+	assert.NoError(t, poller.Poll(ctx))
+	store.AssertExpectations(t)
+}
+
+func TestMemoryLease(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	lease := NewMemoryLease()
+	lease.now = func() time.Time { return now }
+
+	ok, _ := lease.Acquire(ctx, "l", "a", time.Minute)
+	assert.True(t, ok)
+	ok, _ = lease.Acquire(ctx, "l", "b", time.Minute)
+	assert.False(t, ok)
+	ok, _ = lease.Acquire(ctx, "l", "a", time.Minute)
+	assert.True(t, ok, "holders can renew")
+
+	now = now.Add(2 * time.Minute)
+	ok, _ = lease.Acquire(ctx, "l", "b", time.Minute)
+	assert.True(t, ok, "expired leases can be taken")
+}
+
+// Grants the lease once then refuses renewals
+type losingLease struct {
+	mu       sync.Mutex
+	acquired int
+	released bool
+}
+
+func (l *losingLease) Acquire(context.Context, string, string, time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acquired++
+	return l.acquired == 1, nil
+}
+
+func (l *losingLease) Release(context.Context, string, string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.released = true
+	return nil
+}
+
+func TestProcessAllUndeliverableMessages_lostLease(t *testing.T) {
+	store := &MockStore{}
+	lease := &losingLease{}
+	page := &MessagePage{More: false, PageSize: 2, Items: []Message{{Id: "1", Data: MessageData{AccountId: "a"}}, {Id: "2", Data: MessageData{AccountId: "a"}}}}
+	store.On("GetUndeliverable", mock.Anything, "hook1", 20, 1).Return(page, nil)
+	store.On("DismissUndeliverable", ctx, "hook1", []string{"1"}).Return(nil)
+	s := &Settings{Undeliverable: &UndeliverableOptions{Lease: lease, LeaseTTL: 3 * time.Millisecond}}
+	p := s.undeliverableProcessor(store, func(ctx context.Context, m *Message) error {
+		if m.Id == "2" {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	assert.Error(t, p.processAllUndeliverableMessages(ctx, "hook1", "2"))
+	store.AssertExpectations(t)
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+	assert.True(t, lease.released)
+}
+
+func TestProcessAllUndeliverableMessages_lostLeaseNotCounted(t *testing.T) {
+	store := &MockStore{}
+	page := &MessagePage{More: false, PageSize: 1, Items: []Message{{Id: "1"}}}
+	store.On("GetUndeliverable", mock.Anything, "hook1", 20, 1).Return(page, nil)
+	deadLetters := NewMemoryDeadLetterStore()
+	s := &Settings{Undeliverable: &UndeliverableOptions{Lease: &losingLease{}, LeaseTTL: 3 * time.Millisecond, MaxFailures: 1, DeadLetters: deadLetters}}
+	p := s.undeliverableProcessor(store, func(ctx context.Context, m *Message) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	assert.Error(t, p.processAllUndeliverableMessages(ctx, "hook1", "1"))
+	letters, _ := deadLetters.List(ctx)
+	assert.Empty(t, letters, "messages stopped by losing the lease aren't dead-lettered")
+	store.AssertNotCalled(t, "DismissUndeliverable", mock.Anything, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,207 @@
+package eml
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueuedMessage is a message waiting for an AsyncProcessor worker
+type QueuedMessage struct {
+	// Assigned by the queue on Push
+	Seq      int64    `json:"seq"`
+	Message  *Message `json:"message"`
+	Attempts int      `json:"attempts"`
+	// Not handed out by Pop before this time, for retry backoff
+	NotBefore time.Time `json:"not_before"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Queue holds messages between acknowledging them to EML and handling them
+type Queue interface {
+	// Push adds a message, setting its Seq
+	Push(ctx context.Context, m *QueuedMessage) error
+	// Pop blocks until a message is ready or ctx is done
+	Pop(ctx context.Context) (*QueuedMessage, error)
+	// Ack removes a popped message for good, until then a durable queue hands it out again after a restart
+	Ack(ctx context.Context, seq int64) error
+}
+
+// MemoryQueue loses its messages when the process exits
+type MemoryQueue struct {
+	mu      sync.Mutex
+	pending []*QueuedMessage
+	seq     int64
+	notify  chan struct{}
+	now     func() time.Time
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{notify: make(chan struct{}, 1), now: time.Now}
+}
+
+func (q *MemoryQueue) Push(_ context.Context, m *QueuedMessage) error {
+	q.mu.Lock()
+	q.seq++
+	m.Seq = q.seq
+	q.pending = append(q.pending, m)
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+func (q *MemoryQueue) Pop(ctx context.Context) (*QueuedMessage, error) {
+	for {
+		m, wait := q.next()
+		if m != nil {
+			return m, nil
+		}
+		var timer *time.Timer
+		var ready <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			ready = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, ctx.Err()
+		case <-q.notify:
+		case <-ready:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (q *MemoryQueue) Ack(context.Context, int64) error {
+	return nil
+}
+
+// Len counts the messages not yet popped
+func (q *MemoryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Takes the oldest ready message, or returns how long until one is ready, zero meaning wait for a Push
+func (q *MemoryQueue) next() (*QueuedMessage, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	var wait time.Duration
+	for i, m := range q.pending {
+		if !m.NotBefore.After(now) {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			if len(q.pending) > 0 {
+				// Pass the wake-up on to another waiting worker
+				q.signal()
+			}
+			return m, 0
+		}
+		if d := m.NotBefore.Sub(now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+func (q *MemoryQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// FileQueue keeps its messages in memory and logs pushes and acks to a file, messages pushed but not acked are
+// queued again when the file is reopened
+type FileQueue struct {
+	*MemoryQueue
+	// Held across the memory and file updates so records are written in the order they happen
+	mu   sync.Mutex
+	file *jsonLinesFile
+}
+
+const (
+	queueOpPush = "push"
+	queueOpAck  = "ack"
+)
+
+type queueRecord struct {
+	Op      string         `json:"op"`
+	Seq     int64          `json:"seq,omitempty"`
+	Message *QueuedMessage `json:"message,omitempty"`
+}
+
+// NewFileQueue loads unacknowledged messages from path, compacting the file
+func NewFileQueue(path string) (*FileQueue, error) {
+	mem := NewMemoryQueue()
+	pending := map[int64]*QueuedMessage{}
+	err := readJsonLines(path, func(line []byte) {
+		var r queueRecord
+		// Skip a torn final line from a crash
+		if err := json.Unmarshal(line, &r); err != nil {
+			return
+		}
+		switch r.Op {
+		case queueOpPush:
+			if r.Message != nil {
+				pending[r.Message.Seq] = r.Message
+			}
+		case queueOpAck:
+			delete(pending, r.Seq)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for seq, m := range pending {
+		mem.pending = append(mem.pending, m)
+		if seq > mem.seq {
+			mem.seq = seq
+		}
+	}
+	sort.Slice(mem.pending, func(i, j int) bool { return mem.pending[i].Seq < mem.pending[j].Seq })
+	err = rewriteJsonLines(path, func(enc *json.Encoder) error {
+		for _, m := range mem.pending {
+			if err := enc.Encode(queueRecord{Op: queueOpPush, Message: m}); err != nil {
+				return ContextualError(err, "json.Encode")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f, err := openJsonLines(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileQueue{MemoryQueue: mem, file: f}, nil
+}
+
+// Push returns once the message is synced to disk, so it is safe to acknowledge it to EML
+func (f *FileQueue) Push(ctx context.Context, m *QueuedMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.MemoryQueue.Push(ctx, m); err != nil {
+		return err
+	}
+	return f.file.append(queueRecord{Op: queueOpPush, Message: m}, true)
+}
+
+func (f *FileQueue) Ack(_ context.Context, seq int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.append(queueRecord{Op: queueOpAck, Seq: seq}, false)
+}
+
+func (f *FileQueue) Close() error {
+	return f.file.Close()
+}
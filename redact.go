@@ -0,0 +1,235 @@
+package eml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const redactedMask = "[REDACTED]"
+
+// JSON fields and log keys masked by DefaultRedactor
+var DefaultRedactedFields = []string{
+	"card_number",
+	"email",
+	"email_address",
+	"mobile",
+	"mobile_number",
+	"phone",
+	"date_of_birth",
+	"first_name",
+	"last_name",
+	"name_on_card",
+	"primary_address",
+	"alternate_address",
+	"address_line1",
+	"security_code",
+	"access_token",
+	"hmac_key_secret",
+	"secret",
+}
+
+// Headers which are always masked in debug output
+var redactedHeaders = []string{headerActualAuth, headerForwardedAuth, headerUserInfo}
+
+// 13 to 19 digits, optionally grouped by single spaces or dashes
+var panPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+
+type Redactor struct {
+	fields      map[string]bool
+	textPattern *regexp.Regexp
+}
+
+// NewRedactor masks the given JSON fields and log keys (case insensitive), plus any PAN-like digit runs
+func NewRedactor(fields ...string) *Redactor {
+	r := &Redactor{fields: make(map[string]bool, len(fields))}
+	quoted := make([]string, 0, len(fields))
+	for _, f := range fields {
+		f = strings.ToLower(f)
+		if f == "" || r.fields[f] {
+			continue
+		}
+		r.fields[f] = true
+		quoted = append(quoted, regexp.QuoteMeta(f))
+	}
+	if len(quoted) > 0 {
+		// Scalar values of sensitive keys in text which isn't valid JSON, e.g. truncated bodies
+		r.textPattern = regexp.MustCompile(`(?i)("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"|[-\d.]+)`)
+	}
+	return r
+}
+
+func DefaultRedactor() *Redactor {
+	return NewRedactor(DefaultRedactedFields...)
+}
+
+func (r *Redactor) IsSensitive(key string) bool {
+	return r.fields[strings.ToLower(key)]
+}
+
+// Redact masks s, walking it as JSON when possible and otherwise treating it as plain text
+func (r *Redactor) Redact(s string) string {
+	trimmed := strings.TrimSpace(s)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		if out, ok := r.redactJson([]byte(trimmed)); ok {
+			return string(out)
+		}
+	}
+	return r.RedactText(s)
+}
+
+func (r *Redactor) RedactBytes(b []byte) []byte {
+	return []byte(r.Redact(string(b)))
+}
+
+func (r *Redactor) RedactText(s string) string {
+	if r.textPattern != nil {
+		s = r.textPattern.ReplaceAllString(s, `${1}"`+redactedMask+`"`)
+	}
+	return MaskPans(s)
+}
+
+func (r *Redactor) RedactHeaders(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		out[k] = v
+	}
+	for _, k := range redactedHeaders {
+		if out.Get(k) != "" {
+			out.Set(k, redactedMask)
+		}
+	}
+	return out
+}
+
+// RedactValue masks a log field value, strings and errors are redacted as text and composite values are flattened first
+func (r *Redactor) RedactValue(key string, v interface{}) interface{} {
+	if r.IsSensitive(key) {
+		return redactedMask
+	}
+	switch t := v.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64,
+		time.Duration, time.Time, LogLevel:
+		return v
+	case string:
+		return r.Redact(t)
+	case []byte:
+		return r.Redact(string(t))
+	case error:
+		return r.Redact(t.Error())
+	case fmt.Stringer:
+		return r.Redact(t.String())
+	}
+	return r.Redact(fmt.Sprintf("%+v", v))
+}
+
+func (r *Redactor) redactJson(b []byte) ([]byte, bool) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil || d.More() {
+		return nil, false
+	}
+	out, err := json.Marshal(r.walk(v))
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+func (r *Redactor) walk(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if r.IsSensitive(k) {
+				if child != nil {
+					t[k] = redactedMask
+				}
+			} else {
+				t[k] = r.walk(child)
+			}
+		}
+		return t
+	case []interface{}:
+		for i, child := range t {
+			t[i] = r.walk(child)
+		}
+		return t
+	case string:
+		return MaskPans(t)
+	}
+	return v
+}
+
+// MaskPans replaces all but the last 4 digits of card-number-like digit runs
+func MaskPans(s string) string {
+	return panPattern.ReplaceAllStringFunc(s, func(pan string) string {
+		digits := 0
+		for _, c := range pan {
+			if c >= '0' && c <= '9' {
+				digits++
+			}
+		}
+		masked := []byte(pan)
+		seen := 0
+		for i, c := range masked {
+			if c >= '0' && c <= '9' {
+				seen++
+				if seen <= digits-4 {
+					masked[i] = '*'
+				}
+			}
+		}
+		return string(masked)
+	})
+}
+
+type redactingLogger struct {
+	l Logger
+	r *Redactor
+}
+
+// NewRedactingLogger masks the message and every field before passing them to l
+func NewRedactingLogger(l Logger, r *Redactor) Logger {
+	if _, ok := l.(nopLogger); ok || l == nil {
+		return nopLogger{}
+	}
+	return &redactingLogger{l: l, r: redactorOrDefault(r)}
+}
+
+func (rl *redactingLogger) Debug(msg string, fields ...Field) {
+	rl.l.Debug(rl.r.RedactText(msg), rl.fields(fields)...)
+}
+
+func (rl *redactingLogger) Info(msg string, fields ...Field) {
+	rl.l.Info(rl.r.RedactText(msg), rl.fields(fields)...)
+}
+
+func (rl *redactingLogger) Warn(msg string, fields ...Field) {
+	rl.l.Warn(rl.r.RedactText(msg), rl.fields(fields)...)
+}
+
+func (rl *redactingLogger) Error(msg string, fields ...Field) {
+	rl.l.Error(rl.r.RedactText(msg), rl.fields(fields)...)
+}
+
+func (rl *redactingLogger) fields(fields []Field) []Field {
+	out := make([]Field, len(fields))
+	for i, f := range fields {
+		out[i] = Field{Key: f.Key, Value: rl.r.RedactValue(f.Key, f.Value)}
+	}
+	return out
+}
+
+var defaultRedactor = DefaultRedactor()
+
+func redactorOrDefault(r *Redactor) *Redactor {
+	if r == nil {
+		return defaultRedactor
+	}
+	return r
+}
@@ -0,0 +1,106 @@
+package eml
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingLogger struct {
+	entries []logEntry
+}
+
+type logEntry struct {
+	level  LogLevel
+	msg    string
+	fields []Field
+}
+
+func (r *recordingLogger) Debug(msg string, fields ...Field) { r.add(LevelDebug, msg, fields) }
+func (r *recordingLogger) Info(msg string, fields ...Field)  { r.add(LevelInfo, msg, fields) }
+func (r *recordingLogger) Warn(msg string, fields ...Field)  { r.add(LevelWarn, msg, fields) }
+func (r *recordingLogger) Error(msg string, fields ...Field) { r.add(LevelError, msg, fields) }
+
+func (r *recordingLogger) add(level LogLevel, msg string, fields []Field) {
+	r.entries = append(r.entries, logEntry{level: level, msg: msg, fields: fields})
+}
+
+func TestMaskPans(t *testing.T) {
+	tests := map[string]string{
+		"5123456789012346":            "************2346",
+		"card 5123 4567 8901 2346 ok": "card **** **** **** 2346 ok",
+		"card 5123-4567-8901-2346":    "card ****-****-****-2346",
+		"4111111111111":               "*********1111",
+		"id 123456789012":             "id 123456789012",
+		"12345678901234567890":        "12345678901234567890",
+		"ids 1234 5678 and 9012 3456": "ids 1234 5678 and 9012 3456",
+	}
+	for in, expected := range tests {
+		assert.Equal(t, expected, MaskPans(in), "masking %q", in)
+	}
+}
+
+func TestRedactor_RedactJson(t *testing.T) {
+	r := DefaultRedactor()
+	body := `{"id":"m1","data":{"account_id":"eaid","card_number":"5123456789012346","personal":{"first_name":"Jo","email_address":"jo@example.com","primary_address":{"address_line1":"1 St"}},"details":{"description":"ref 5123456789012346"},"balance":12.5,"mobile_number":null}}`
+	out := r.Redact(body)
+	assert.NotContains(t, out, "5123456789012346")
+	assert.NotContains(t, out, "jo@example.com")
+	assert.NotContains(t, out, "1 St")
+	assert.NotContains(t, out, `"Jo"`)
+	assert.Contains(t, out, `"card_number":"[REDACTED]"`)
+	assert.Contains(t, out, `"primary_address":"[REDACTED]"`)
+	assert.Contains(t, out, `"description":"ref ************2346"`)
+	assert.Contains(t, out, `"account_id":"eaid"`)
+	assert.Contains(t, out, `"balance":12.5`)
+	assert.Contains(t, out, `"mobile_number":null`)
+}
+
+func TestRedactor_RedactText(t *testing.T) {
+	r := DefaultRedactor()
+	truncated := `{"Card_Number": "5123456789012346", "email_address" : "jo@example.com", "date_of_birth": "1990-01-01", "account_id": "eaid", "desc`
+	out := r.Redact(truncated)
+	assert.Equal(t, `{"Card_Number": "[REDACTED]", "email_address" : "[REDACTED]", "date_of_birth": "[REDACTED]", "account_id": "eaid", "desc`, out)
+}
+
+func TestRedactor_CustomFields(t *testing.T) {
+	r := NewRedactor("client_account_key")
+	out := r.Redact(`{"client_account_key":"abc","email_address":"jo@example.com"}`)
+	assert.Contains(t, out, `"client_account_key":"[REDACTED]"`)
+	assert.Contains(t, out, `"email_address":"jo@example.com"`)
+}
+
+func TestRedactor_RedactHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer token")
+	h.Set("Accept", contentTypeJson)
+	out := DefaultRedactor().RedactHeaders(h)
+	assert.Equal(t, "[REDACTED]", out.Get("Authorization"))
+	assert.Equal(t, contentTypeJson, out.Get("Accept"))
+	assert.Equal(t, "Bearer token", h.Get("Authorization"), "original headers should not be modified")
+}
+
+func TestRedactingLogger(t *testing.T) {
+	rec := &recordingLogger{}
+	l := NewRedactingLogger(rec, nil)
+	l.Info("Updating card 5123456789012346",
+		KV("eaid", "eaid"),
+		KV("email", "jo@example.com"),
+		KV("count", 3),
+		KV("body", `{"card_number":"5123456789012346"}`),
+		ErrField(errors.New("declined 5123456789012346")))
+
+	assert.Len(t, rec.entries, 1)
+	e := rec.entries[0]
+	assert.Equal(t, LevelInfo, e.level)
+	assert.Equal(t, "Updating card ************2346", e.msg)
+	assert.Equal(t, []Field{
+		KV("eaid", "eaid"),
+		KV("email", "[REDACTED]"),
+		KV("count", 3),
+		KV("body", `{"card_number":"[REDACTED]"}`),
+		KV("error", "declined ************2346"),
+	}, e.fields)
+}
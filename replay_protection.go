@@ -0,0 +1,91 @@
+package eml
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultReplayWindow = 5 * time.Minute
+
+const (
+	ErrorStaleMessage    sUserErrorMessage = "Message timestamp is outside the accepted window"
+	ErrorReplayedMessage sUserErrorMessage = "Message is already being handled"
+)
+
+// ReplayProtection rejects webhooks whose timestamp is outside a window around now, and acknowledges webhooks already
+// handled within that window without handling them again, so a captured signed payload can't be resent later and
+// EML's retry after a lost response isn't counted twice. A copy arriving while the first is still being handled is
+// rejected with 409 Conflict. Messages redelivered by processing undeliverables
+// don't go through the webhook so are always accepted.
+type ReplayProtection struct {
+	// Timestamps further than this from now are rejected, in either direction to allow for clock skew. 5 minutes
+	// when zero or negative.
+	Window time.Duration
+	// Remembers message ID and timestamp pairs, a MemoryDedupStore covering twice the window when nil
+	Nonces DedupStore
+	// time.Now when nil
+	Now func() time.Time
+
+	once sync.Once
+}
+
+func (p *ReplayProtection) nonces() DedupStore {
+	p.once.Do(func() {
+		if p.Nonces == nil {
+			p.Nonces = NewMemoryDedupStore(2 * p.window())
+		}
+	})
+	return p.Nonces
+}
+
+func (p *ReplayProtection) window() time.Duration {
+	if p.Window > 0 {
+		return p.Window
+	}
+	return defaultReplayWindow
+}
+
+func (p *ReplayProtection) now() time.Time {
+	if p.Now != nil {
+		return p.Now()
+	}
+	return time.Now()
+}
+
+// Claims the message's nonce, the returned func completes it once the message is handled or releases it if
+// handling failed so EML can redeliver it. handled is true when the message was already handled and should just be
+// acknowledged.
+func (p *ReplayProtection) claim(ctx context.Context, message *Message) (finish func(ctx context.Context, err error) error, handled bool, err error) {
+	if p == nil {
+		return func(context.Context, error) error { return nil }, false, nil
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, message.Timestamp)
+	if err != nil {
+		return nil, false, NewHttpError(http.StatusUnauthorized, ErrorStaleMessage, ContextualError(err, "time.Parse %q", message.Timestamp))
+	}
+	now := p.now()
+	if age, window := now.Sub(timestamp), p.window(); age > window || age < -window {
+		return nil, false, NewHttpError(http.StatusUnauthorized, ErrorStaleMessage, fmt.Errorf("message %s timestamp %s is %s from now", message.Id, message.Timestamp, age))
+	}
+	nonce := message.Id + "@" + timestamp.UTC().Format(time.RFC3339Nano)
+	nonces := p.nonces()
+	state, err := nonces.Claim(ctx, nonce)
+	if err != nil {
+		return nil, false, ContextualError(err, "nonces.Claim")
+	}
+	switch state {
+	case DedupDone:
+		return nil, true, nil
+	case DedupInProgress:
+		return nil, false, NewHttpError(http.StatusConflict, ErrorReplayedMessage, fmt.Errorf("message %s at %s is already being handled", message.Id, message.Timestamp))
+	}
+	return func(ctx context.Context, err error) error {
+		if err != nil {
+			return nonces.Release(ctx, nonce)
+		}
+		return nonces.Complete(ctx, nonce)
+	}, false, nil
+}
@@ -0,0 +1,59 @@
+package eml
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayProtection(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	fail := true
+	calls := 0
+	deps := &Dependencies{
+		Config:           &Config{NotificationHookId: "hook1", HmacKey: testHmacKey},
+		ReplayProtection: &ReplayProtection{Window: 5 * time.Minute, Now: func() time.Time { return now }},
+	}
+	handler := NewWebhookHandler(deps, WithTransactionHandler(func(ctx context.Context, m *Message) error {
+		calls++
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	}))
+	client := NewWebhookTestClient(testHmacKey, "http://localhost/eml")
+	send := func(timestamp time.Time) int {
+		m := testTxnMessage()
+		m.Timestamp = timestamp.Format(time.RFC3339Nano)
+		rec, _ := serveMessage(client, handler, m)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, send(now.Add(-time.Minute)))
+	fail = false
+	assert.Equal(t, http.StatusOK, send(now.Add(-time.Minute)), "failed messages can be redelivered")
+	assert.Equal(t, http.StatusOK, send(now.Add(-time.Minute)), "replays are acknowledged")
+	assert.Equal(t, 2, calls, "without being handled again")
+
+	assert.Equal(t, http.StatusUnauthorized, send(now.Add(-time.Hour)))
+	assert.Equal(t, http.StatusUnauthorized, send(now.Add(time.Hour)))
+	assert.Equal(t, http.StatusUnauthorized, send(time.Time{}))
+	assert.Equal(t, 2, calls)
+}
+
+func TestReplayProtection_defaultWindow(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	p := &ReplayProtection{Now: func() time.Time { return now }}
+	claim := func(id string, timestamp time.Time) error {
+		_, _, err := p.claim(ctx, &Message{Id: id, Timestamp: timestamp.Format(time.RFC3339Nano)})
+		return err
+	}
+
+	assert.NoError(t, claim("m1", now.Add(-time.Minute)), "a zero window defaults to 5 minutes")
+	assert.Equal(t, http.StatusConflict, errorStatus(claim("m1", now.Add(-time.Minute))), "copies are rejected while in progress")
+	assert.Equal(t, http.StatusUnauthorized, errorStatus(claim("m2", now.Add(-10*time.Minute))))
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"strings"
 )
@@ -61,41 +62,80 @@ func (r *Request) GetEmlMessageSpec() (messageType, version string, err error) {
 
 // Read from the passed reader, returning another reader to re-read the body
 func (r *Request) CheckHmacSignature(key *Key, body io.Reader) (io.Reader, error) {
+	return r.CheckHmacSignatureKeys(singleKey{key}, body)
+}
+
+// As CheckHmacSignature, using the key matching the header's key ID
+func (r *Request) CheckHmacSignatureKeys(keys KeyLookup, body io.Reader) (io.Reader, error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, body); err != nil {
+		return &buf, err
+	}
+	return &buf, r.VerifyHmacSignature(keys, buf.Bytes())
+}
+
+// VerifyHmacSignature checks the Authorization header is an HMAC_SHA256 of the raw body
+func (r *Request) VerifyHmacSignature(keys KeyLookup, body []byte) error {
 	header := r.Header.Get(headerActualAuth)
 	if header == "" {
-		return body, fmt.Errorf("no Authorization header")
+		return fmt.Errorf("no Authorization header")
 	}
 	parts := strings.Split(header, " ")
 	if parts[0] != hmacSha256 {
-		return body, fmt.Errorf("invalid HMAC algorithm %s", parts[0])
+		return fmt.Errorf("invalid HMAC algorithm %s", parts[0])
 	}
 	if len(parts) < 2 || !strings.Contains(parts[1], ";") {
-		return body, fmt.Errorf("invalid Auth header %s", header)
+		return fmt.Errorf("invalid Auth header %s", header)
 	}
 	values := strings.Split(parts[1], ";")
 	keyId, messageHex := values[0], values[1]
-	if key == nil {
-		return body, fmt.Errorf("unknown key ID %s", keyId)
+	key, err := keys.LookupKey(keyId)
+	if err != nil {
+		return err
 	}
 	secretBytes, err := key.SecretBytes()
 	if err != nil {
-		return body, err
+		return err
 	}
 	mac := hmac.New(sha256.New, secretBytes)
-	var buf bytes.Buffer
-	if _, err := io.Copy(mac, io.TeeReader(body, &buf)); err != nil {
-		return &buf, err
+	mac.Write(body)
+	messageMac, err := hex.DecodeString(messageHex)
+	if err != nil {
+		return err
 	}
-	expectedMac := mac.Sum(nil)
+	if !hmac.Equal(messageMac, mac.Sum(nil)) {
+		return fmt.Errorf("hash %s doesn't match for key ID %s", messageHex, keyId)
+	}
+	return nil
+}
 
-	messageMac, err := hex.DecodeString(messageHex)
+// CheckJsonContentType fails with 415 Unsupported Media Type unless the body is declared as JSON
+func (r *Request) CheckJsonContentType() error {
+	contentType := r.Header.Get(headerContentType)
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || (mediaType != contentTypeJson && !strings.HasSuffix(mediaType, "+json")) {
+		return NewHttpError(http.StatusUnsupportedMediaType, ErrorUnsupportedType, fmt.Errorf("unsupported content type %q", contentType))
+	}
+	return nil
+}
+
+// ReadBody reads the whole body, failing with 413 Request Entity Too Large if it is over limit bytes
+func (r *Request) ReadBody(limit int64) ([]byte, error) {
+	if r.ContentLength > limit {
+		return nil, bodyTooLargeError(limit)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
 	if err != nil {
-		return &buf, err
+		return nil, BadError(ErrorParsingBody, ContextualError(err, "ioutil.ReadAll"))
 	}
-	if !hmac.Equal(messageMac, expectedMac) {
-		return &buf, fmt.Errorf("hash %s doesn't match expected %s\n", messageHex, hex.EncodeToString(expectedMac))
+	if int64(len(body)) > limit {
+		return nil, bodyTooLargeError(limit)
 	}
-	return &buf, nil
+	return body, nil
+}
+
+func bodyTooLargeError(limit int64) error {
+	return NewHttpError(http.StatusRequestEntityTooLarge, ErrorBodyTooLarge, fmt.Errorf("body is over %d bytes", limit))
 }
 
 func NewRequest(r *http.Request) (*Request, error) {
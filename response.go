@@ -3,7 +3,6 @@ package eml
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 )
 
@@ -21,10 +20,16 @@ type Response interface {
 
 type emlResponse struct {
 	http.ResponseWriter
+	log Logger
 }
 
 func NewResponse(w http.ResponseWriter) Response {
-	return &emlResponse{w}
+	return &emlResponse{ResponseWriter: w, log: nopLogger{}}
+}
+
+// NewResponseWithLogger reports errors passed to HandleError through l
+func NewResponseWithLogger(w http.ResponseWriter, l Logger) Response {
+	return &emlResponse{ResponseWriter: w, log: loggerOrNop(l)}
 }
 
 type ErrorResponse struct {
@@ -76,10 +81,11 @@ func (r *emlResponse) HandleJsonOk(model interface{}, err error) error {
 }
 
 func (r *emlResponse) HandleError(err interface{}) {
-	log.Println(err)
 	if e, ok := err.(Error); ok {
+		r.log.Error("Request failed", KV("status", e.Status()), ErrField(e))
 		r.Error(e.Status(), e.UserMessage(), e.ValidationErrors())
 	} else {
+		r.log.Error("Request failed", KV("status", http.StatusInternalServerError), KV("error", err))
 		r.Error(http.StatusInternalServerError, ErrorInternal, nil)
 	}
 }
@@ -0,0 +1,127 @@
+package eml
+
+import (
+	"context"
+)
+
+type TxnEventType string
+
+const (
+	EventAuthorisation       TxnEventType = "authorisation"
+	EventClearing            TxnEventType = "clearing"
+	EventPosting             TxnEventType = "posting"
+	EventDecline             TxnEventType = "decline"
+	EventReversal            TxnEventType = "reversal"
+	EventAccountStatusChange TxnEventType = "account_status_change"
+	EventWalletTransaction   TxnEventType = "wallet_transaction"
+)
+
+// MessageEvents classifies a transaction message, a message can be more than one event e.g. a wallet authorisation
+func MessageEvents(m *Message) []TxnEventType {
+	events := make([]TxnEventType, 0, 2)
+	switch m.Data.StateChange.NewState {
+	case StateAuthorized:
+		events = append(events, EventAuthorisation)
+	case StateCleared:
+		events = append(events, EventClearing)
+	case StatePosted:
+		events = append(events, EventPosting)
+	case StateReversed:
+		events = append(events, EventReversal)
+	}
+	if m.Data.StateChange.NewState == StateDeclined || m.Data.Details.DeclineReason != "" {
+		events = append(events, EventDecline)
+	}
+	if m.Data.Details.IsAccountStatusChange {
+		events = append(events, EventAccountStatusChange)
+	}
+	if m.Data.Details.MobileWallet != WalletNone {
+		events = append(events, EventWalletTransaction)
+	}
+	return events
+}
+
+type MessagePredicate func(m *Message) bool
+
+func IsEvent(event TxnEventType) MessagePredicate {
+	return func(m *Message) bool {
+		for _, e := range MessageEvents(m) {
+			if e == event {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func FromSource(source string) MessagePredicate {
+	return func(m *Message) bool {
+		return m.Data.Details.Source == source
+	}
+}
+
+func DeclinedFor(reason TxnDeclineReason) MessagePredicate {
+	return func(m *Message) bool {
+		return m.Data.Details.DeclineReason == reason
+	}
+}
+
+func AllOf(predicates ...MessagePredicate) MessagePredicate {
+	return func(m *Message) bool {
+		for _, p := range predicates {
+			if !p(m) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+type route struct {
+	match   MessagePredicate
+	handler TransactionHandler
+}
+
+// Router calls every handler whose event or predicate matches a message, in the order they were registered.
+// Use router.Handle wherever a TransactionHandler is expected.
+type Router struct {
+	routes   []route
+	fallback TransactionHandler
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+func (r *Router) On(event TxnEventType, h TransactionHandler) *Router {
+	return r.When(IsEvent(event), h)
+}
+
+func (r *Router) When(p MessagePredicate, h TransactionHandler) *Router {
+	r.routes = append(r.routes, route{match: p, handler: h})
+	return r
+}
+
+// Default handles messages no route matched, they are acknowledged when it isn't set
+func (r *Router) Default(h TransactionHandler) *Router {
+	r.fallback = h
+	return r
+}
+
+// Handle stops at the first handler error so the message can be redelivered
+func (r *Router) Handle(ctx context.Context, m *Message) error {
+	matched := false
+	for _, rt := range r.routes {
+		if !rt.match(m) {
+			continue
+		}
+		matched = true
+		if err := rt.handler(ctx, m); err != nil {
+			return err
+		}
+	}
+	if !matched && r.fallback != nil {
+		return r.fallback(ctx, m)
+	}
+	return nil
+}
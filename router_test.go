@@ -0,0 +1,66 @@
+package eml
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func txnMessage(state TxnState, details TxnDetails) *Message {
+	return &Message{Id: "m1", Type: TxnTypeTransaction, Data: MessageData{
+		StateChange: TxnStateChange{NewState: state},
+		Details:     details,
+	}}
+}
+
+func TestMessageEvents(t *testing.T) {
+	assert.Equal(t, []TxnEventType{EventAuthorisation}, MessageEvents(txnMessage(StateAuthorized, TxnDetails{})))
+	assert.Equal(t, []TxnEventType{EventClearing}, MessageEvents(txnMessage(StateCleared, TxnDetails{})))
+	assert.Equal(t, []TxnEventType{EventPosting}, MessageEvents(txnMessage(StatePosted, TxnDetails{})))
+	assert.Equal(t, []TxnEventType{EventReversal}, MessageEvents(txnMessage(StateReversed, TxnDetails{})))
+	assert.Equal(t, []TxnEventType{EventDecline}, MessageEvents(txnMessage(StateDeclined, TxnDetails{DeclineReason: DeclineIncorrectPin})))
+	assert.Equal(t, []TxnEventType{EventAccountStatusChange}, MessageEvents(txnMessage(StateNew, TxnDetails{IsAccountStatusChange: true})))
+	assert.Equal(t, []TxnEventType{EventAuthorisation, EventWalletTransaction}, MessageEvents(txnMessage(StateAuthorized, TxnDetails{MobileWallet: WalletApple})))
+}
+
+func TestRouter_Handle(t *testing.T) {
+	var calls []string
+	record := func(name string) TransactionHandler {
+		return func(ctx context.Context, m *Message) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+	r := NewRouter().
+		On(EventAuthorisation, record("auth")).
+		On(EventWalletTransaction, record("wallet")).
+		When(AllOf(IsEvent(EventDecline), DeclinedFor(DeclineInsufficientFunds)), record("nsf")).
+		When(FromSource(SourceVisa), record("visa")).
+		Default(record("default"))
+	var h TransactionHandler = r.Handle
+
+	assert.NoError(t, h(ctx, txnMessage(StateAuthorized, TxnDetails{MobileWallet: WalletGoogle, Source: SourceVisa})))
+	assert.Equal(t, []string{"auth", "wallet", "visa"}, calls)
+
+	calls = nil
+	assert.NoError(t, h(ctx, txnMessage(StateDeclined, TxnDetails{DeclineReason: DeclineInsufficientFunds})))
+	assert.Equal(t, []string{"nsf"}, calls)
+
+	calls = nil
+	assert.NoError(t, h(ctx, txnMessage(StatePosted, TxnDetails{})))
+	assert.Equal(t, []string{"default"}, calls)
+}
+
+func TestRouter_HandleError(t *testing.T) {
+	failed := errors.New("failed")
+	called := false
+	r := NewRouter().
+		On(EventPosting, func(ctx context.Context, m *Message) error { return failed }).
+		On(EventPosting, func(ctx context.Context, m *Message) error { called = true; return nil })
+
+	assert.Equal(t, failed, r.Handle(ctx, txnMessage(StatePosted, TxnDetails{})))
+	assert.False(t, called, "handlers after an error should not be called")
+	assert.NoError(t, r.Handle(ctx, txnMessage(StateCleared, TxnDetails{})), "unmatched messages are acknowledged")
+}
@@ -0,0 +1,90 @@
+package eml
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const defaultMessageVersion = "1.0.0"
+
+// SignMessage returns the Authorization header value EML would send with body
+func SignMessage(key *Key, body []byte) (string, error) {
+	if key == nil {
+		return "", fmt.Errorf("no key to sign with")
+	}
+	secretBytes, err := key.SecretBytes()
+	if err != nil {
+		return "", ContextualError(err, "key.SecretBytes")
+	}
+	mac := hmac.New(sha256.New, secretBytes)
+	mac.Write(body)
+	return fmt.Sprintf("%s %s;%s", hmacSha256, key.Id, hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// MessageSpecification returns the X-Message-Specification header value for a message, e.g. transaction@1.0.0
+func MessageSpecification(m *Message) string {
+	messageType, version := m.Type, m.Version
+	if messageType == "" {
+		messageType = TxnTypeTransaction
+	}
+	if version == "" {
+		version = defaultMessageVersion
+	}
+	return messageType + "@" + version
+}
+
+// WebhookTestClient sends signed webhook requests as EML would, for testing handlers. To call a handler without a
+// server, pass NewRequest's request to its ServeHTTP with an httptest.ResponseRecorder.
+type WebhookTestClient struct {
+	Key    *Key
+	Url    string
+	Client *http.Client
+}
+
+func NewWebhookTestClient(key *Key, url string) *WebhookTestClient {
+	return &WebhookTestClient{Key: key, Url: url, Client: http.DefaultClient}
+}
+
+// NewRequest builds a complete signed request for m
+func (c *WebhookTestClient) NewRequest(ctx context.Context, m *Message) (*http.Request, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, ContextualError(err, "json.Marshal")
+	}
+	return c.NewRawRequest(ctx, MessageSpecification(m), body)
+}
+
+// NewRawRequest signs an arbitrary body, e.g. to test malformed payloads
+func (c *WebhookTestClient) NewRawRequest(ctx context.Context, spec string, body []byte) (*http.Request, error) {
+	auth, err := SignMessage(c.Key, body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, ContextualError(err, "http.NewRequest")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(headerContentType, contentTypeJson)
+	req.Header.Set(headerEmlSpecification, spec)
+	req.Header.Set(headerActualAuth, auth)
+	return req, nil
+}
+
+func (c *WebhookTestClient) Send(ctx context.Context, m *Message) (*http.Response, error) {
+	req, err := c.NewRequest(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
@@ -0,0 +1,79 @@
+package eml
+
+import (
+	"context"
+	"time"
+)
+
+const headerCorrelationId = "X-Correlation-Id"
+
+const (
+	SpanRequest       = "eml.request"
+	SpanTokenRefresh  = "eml.token_refresh"
+	SpanWebhook       = "eml.webhook"
+	SpanUndeliverable = "eml.undeliverable"
+)
+
+// Span describes one traced operation, fields are filled in as they become known
+type Span struct {
+	Name string
+	// Path template for requests, e.g. /3.0/accounts/{id}
+	Endpoint             string
+	Method               string
+	Eaid                 string
+	HookId               string
+	MessageId            string
+	MessageType          string
+	LogicalTransactionId int64
+	CorrelationId        string
+	// HTTP status returned by EML, or sent back for webhooks
+	Status   int
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// TraceHooks are called at the start and end of every EML request, token refresh, webhook and undeliverable message.
+// Either callback may be nil.
+type TraceHooks struct {
+	// The returned context is used for the rest of the span, e.g. to carry a tracer's own span
+	OnStart func(ctx context.Context, span *Span) context.Context
+	OnEnd   func(ctx context.Context, span *Span)
+}
+
+func (t *TraceHooks) start(ctx context.Context, span *Span) context.Context {
+	span.Start = time.Now()
+	if span.CorrelationId == "" {
+		span.CorrelationId = CorrelationId(ctx)
+	}
+	if t == nil || t.OnStart == nil {
+		return ctx
+	}
+	if c := t.OnStart(ctx, span); c != nil {
+		return c
+	}
+	return ctx
+}
+
+func (t *TraceHooks) end(ctx context.Context, span *Span, err error) {
+	span.Duration = time.Since(span.Start)
+	span.Err = err
+	if t == nil || t.OnEnd == nil {
+		return
+	}
+	t.OnEnd(ctx, span)
+}
+
+type correlationIdKey struct{}
+
+// WithCorrelationId sets the ID sent to EML in the X-Correlation-Id header and reported on spans
+func WithCorrelationId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIdKey{}, id)
+}
+
+func CorrelationId(ctx context.Context) string {
+	if id, ok := ctx.Value(correlationIdKey{}).(string); ok {
+		return id
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package eml
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test spans are reported for EML calls and the correlation ID is sent as a header
+func Test_emlStore_Tracing(t *testing.T) {
+	var started []string
+	var ended []Span
+	hooks := &TraceHooks{
+		OnStart: func(ctx context.Context, span *Span) context.Context {
+			started = append(started, span.Name)
+			return ctx
+		},
+		OnEnd: func(ctx context.Context, span *Span) {
+			ended = append(ended, *span)
+		},
+	}
+	e := &Settings{EmlRestId: clientId, EmlHostUrl: baseUrl, Tracing: hooks}
+	store := &emlStore{_restSecret: clientSecret, _env: e}
+	store.lazyInit(ctx)
+
+	httpmock.ActivateNonDefault(store._lazyClient.GetClient())
+	defer httpmock.DeactivateAndReset()
+	mockTokenResponse(t)
+	httpmock.RegisterResponder("PUT", "https://eml.com/3.0/accounts/eaid/status", func(req *http.Request) (*http.Response, error) {
+		assert.Equal(t, "corr-1", req.Header.Get("X-Correlation-Id"))
+		return httpmock.NewJsonResponse(400, ErrorModel{Code: "invalid_status", Description: "bad status"})
+	})
+
+	err := store.UpdateStatus(WithCorrelationId(ctx, "corr-1"), "eaid", CardStatusActive)
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{SpanTokenRefresh, SpanRequest}, started)
+	assert.Len(t, ended, 2)
+	token, request := ended[0], ended[1]
+	assert.Equal(t, SpanTokenRefresh, token.Name)
+	assert.Equal(t, http.StatusOK, token.Status)
+	assert.NoError(t, token.Err)
+	assert.Equal(t, SpanRequest, request.Name)
+	assert.Equal(t, "/3.0/accounts/{id}/status", request.Endpoint)
+	assert.Equal(t, "PUT", request.Method)
+	assert.Equal(t, "eaid", request.Eaid)
+	assert.Equal(t, "corr-1", request.CorrelationId)
+	assert.Equal(t, http.StatusBadRequest, request.Status)
+	assert.Error(t, request.Err)
+	assert.True(t, request.Duration > 0, "expected a duration")
+}
@@ -0,0 +1,173 @@
+package eml
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUndeliverableWorkers     = 4
+	defaultUndeliverableDismissSize = 50
+)
+
+// UndeliverableOptions tunes how a backlog of undeliverable messages is processed
+type UndeliverableOptions struct {
+	// Messages handled at once, 4 when zero. Messages for the same account are always handled in order.
+	Workers int
+	// Messages dismissed per DismissUndeliverable call, 50 when zero
+	DismissBatchSize int
+	// Called after each batch is dismissed and once processing is done
+	OnProgress func(UndeliverableProgress)
+	// Messages failing this many times are moved to DeadLetters and dismissed, zero keeps retrying them forever
+	MaxFailures int
+	// Required with MaxFailures
+	DeadLetters DeadLetterStore
+	// Counts failures across alerts, a MemoryFailureCounter when nil
+	Failures FailureCounter
+	// Held while draining a hook so only one instance drains it at a time
+	Lease Lease
+	// Identifies this instance to Lease, a random ID when empty
+	LeaseHolder string
+	// How long the lease lasts without renewal, 1 minute when zero. It is renewed every third of this while draining.
+	LeaseTTL time.Duration
+
+	once sync.Once
+}
+
+// UndeliverableProgress counts the messages processed so far for a hook
+type UndeliverableProgress struct {
+	HookId    string
+	Handled   int
+	Failed    int
+	Dismissed int
+	// Failed messages which went over MaxFailures, also counted in Failed and Dismissed
+	DeadLettered int
+	Done         bool
+}
+
+func (o *UndeliverableOptions) workers() int {
+	if o == nil || o.Workers <= 0 {
+		return defaultUndeliverableWorkers
+	}
+	return o.Workers
+}
+
+func (o *UndeliverableOptions) dismissBatchSize() int {
+	if o == nil || o.DismissBatchSize <= 0 {
+		return defaultUndeliverableDismissSize
+	}
+	return o.DismissBatchSize
+}
+
+func (o *UndeliverableOptions) onProgress(progress UndeliverableProgress) {
+	if o != nil && o.OnProgress != nil {
+		o.OnProgress(progress)
+	}
+}
+
+func (o *UndeliverableOptions) deadLettering() bool {
+	return o != nil && o.MaxFailures > 0 && o.DeadLetters != nil
+}
+
+func (o *UndeliverableOptions) setDefaults() {
+	o.once.Do(func() {
+		if o.Failures == nil {
+			o.Failures = NewMemoryFailureCounter()
+		}
+		if o.LeaseHolder == "" {
+			o.LeaseHolder = UniqueID()
+		}
+	})
+}
+
+func (o *UndeliverableOptions) failures() FailureCounter {
+	o.setDefaults()
+	return o.Failures
+}
+
+func (o *UndeliverableOptions) leaseHolder() string {
+	o.setDefaults()
+	return o.LeaseHolder
+}
+
+func (o *UndeliverableOptions) leaseTTL() time.Duration {
+	if o.LeaseTTL <= 0 {
+		return defaultLeaseTTL
+	}
+	return o.LeaseTTL
+}
+
+// FailureCounter counts how many times each message has failed
+type FailureCounter interface {
+	// Fail records a failure, returning the number of failures so far
+	Fail(ctx context.Context, messageId string) (int, error)
+	Reset(ctx context.Context, messageId string) error
+}
+
+// MemoryFailureCounter forgets its counts when the process exits
+type MemoryFailureCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func NewMemoryFailureCounter() *MemoryFailureCounter {
+	return &MemoryFailureCounter{counts: map[string]int{}}
+}
+
+func (m *MemoryFailureCounter) Fail(_ context.Context, messageId string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[messageId]++
+	return m.counts[messageId], nil
+}
+
+func (m *MemoryFailureCounter) Reset(_ context.Context, messageId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.counts, messageId)
+	return nil
+}
+
+// Counts the failure, moving the message to the dead-letter store once it is over the limit. Returns true when the
+// message was dead-lettered and can be dismissed.
+func (p *undeliverableProcessor) deadLetter(ctx context.Context, message *Message, handlerErr error) bool {
+	if !p.options.deadLettering() {
+		return false
+	}
+	failures := p.options.failures()
+	count, err := failures.Fail(ctx, message.Id)
+	if err != nil {
+		p.log.Error("Error counting undelivered message failure", KV("messageId", message.Id), ErrField(err))
+		return false
+	}
+	if count < p.options.MaxFailures {
+		return false
+	}
+	d := &DeadLetter{Message: message, Attempts: count, Error: handlerErr.Error(), Time: time.Now()}
+	if err := p.options.DeadLetters.Put(ctx, d); err != nil {
+		p.log.Error("Error dead-lettering undelivered message", KV("messageId", message.Id), ErrField(err))
+		return false
+	}
+	p.log.Warn("Undelivered message failed too many times, dead-lettered", KV("messageId", message.Id), KV("failures", count), ErrField(handlerErr))
+	if err := failures.Reset(ctx, message.Id); err != nil {
+		p.log.Error("Error resetting undelivered message failures", KV("messageId", message.Id), ErrField(err))
+	}
+	return true
+}
+
+// Messages with the same key must be handled in order, those without an account stand alone
+func undeliverableOrderKey(message *Message) string {
+	if message.Data.AccountId != "" {
+		return message.Data.AccountId
+	}
+	return message.Id
+}
+
+// Picks the worker for a message so each account's messages go to the same worker, in order
+func undeliverableWorker(message *Message, workers int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(undeliverableOrderKey(message)))
+	return int(h.Sum32() % uint32(workers))
+}
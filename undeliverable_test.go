@@ -0,0 +1,190 @@
+package eml
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestProcessAllUndeliverableMessages(t *testing.T) {
+	tests := []struct {
+		name          string
+		failing       string
+		lastMessageId string
+		handled       map[string][]string
+		dismissed     []string
+		dismissCalls  int
+		progress      UndeliverableProgress
+	}{
+		{
+			name:          "last fails",
+			failing:       "6",
+			lastMessageId: "5",
+			handled:       map[string][]string{"a": {"1", "3", "5"}, "b": {"2", "4"}, "c": {"6"}},
+			dismissed:     []string{"1", "2", "3", "4", "5"},
+			dismissCalls:  3,
+			progress:      UndeliverableProgress{HookId: "hook1", Handled: 5, Failed: 1, Dismissed: 5, Done: true},
+		},
+		{
+			// The account's later messages wait for the failed one, so aren't handled or dismissed
+			name:          "early fails",
+			failing:       "1",
+			lastMessageId: "6",
+			handled:       map[string][]string{"a": {"1"}, "b": {"2", "4"}, "c": {"6"}},
+			dismissed:     []string{"2", "4", "6"},
+			dismissCalls:  2,
+			progress:      UndeliverableProgress{HookId: "hook1", Handled: 3, Failed: 1, Dismissed: 3, Done: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &MockStore{}
+			message := func(id, eaid string) Message {
+				return Message{Id: id, Data: MessageData{AccountId: eaid}}
+			}
+			page1 := &MessagePage{More: true, PageSize: 3, Items: []Message{message("1", "a"), message("2", "b"), message("3", "a")}}
+			page2 := &MessagePage{More: false, PageSize: 3, Items: []Message{message("4", "b"), message("5", "a"), message("6", "c")}}
+			store.On("GetUndeliverable", ctx, "hook1", 20, 1).Return(page1, nil)
+			store.On("GetUndeliverable", ctx, "hook1", 3, 2).Return(page2, nil)
+			var mu sync.Mutex
+			var dismissed []string
+			store.On("DismissUndeliverable", ctx, "hook1", mock.Anything).Run(func(args mock.Arguments) {
+				mu.Lock()
+				defer mu.Unlock()
+				dismissed = append(dismissed, args.Get(2).([]string)...)
+			}).Return(nil)
+
+			byAccount := map[string][]string{}
+			var progress []UndeliverableProgress
+			s := &Settings{Undeliverable: &UndeliverableOptions{
+				Workers:          3,
+				DismissBatchSize: 2,
+				OnProgress:       func(p UndeliverableProgress) { progress = append(progress, p) },
+			}}
+			p := s.undeliverableProcessor(store, func(ctx context.Context, m *Message) error {
+				// Earlier messages take longer, so only the per-account ordering keeps them in order
+				id := m.Id[0] - '0'
+				time.Sleep(time.Duration(7-id) * time.Millisecond)
+				mu.Lock()
+				defer mu.Unlock()
+				byAccount[m.Data.AccountId] = append(byAccount[m.Data.AccountId], m.Id)
+				if m.Id == test.failing {
+					return errors.New("failed")
+				}
+				return nil
+			})
+
+			assert.NoError(t, p.processAllUndeliverableMessages(ctx, "hook1", test.lastMessageId))
+			assert.Equal(t, test.handled, byAccount)
+			sort.Strings(dismissed)
+			assert.Equal(t, test.dismissed, dismissed)
+			store.AssertNumberOfCalls(t, "DismissUndeliverable", test.dismissCalls)
+			assert.Equal(t, test.progress, progress[len(progress)-1])
+		})
+	}
+}
+
+// Serves undeliverable messages like EML, dismissing removes them so later pages shift
+type shrinkingUndeliverableStore struct {
+	*MockStore
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (s *shrinkingUndeliverableStore) GetUndeliverable(_ context.Context, _ string, pageSize int, pageNumber int) (*MessagePage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := (pageNumber - 1) * pageSize
+	if start > len(s.messages) {
+		start = len(s.messages)
+	}
+	end := start + pageSize
+	if end > len(s.messages) {
+		end = len(s.messages)
+	}
+	items := append([]Message(nil), s.messages[start:end]...)
+	return &MessagePage{More: end < len(s.messages), PageSize: pageSize, Items: items}, nil
+}
+
+func (s *shrinkingUndeliverableStore) DismissUndeliverable(_ context.Context, _ string, messageIds []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remaining := s.messages[:0]
+	for _, m := range s.messages {
+		if !containsString(messageIds, m.Id) {
+			remaining = append(remaining, m)
+		}
+	}
+	s.messages = remaining
+	return nil
+}
+
+func TestProcessAllUndeliverableMessages_dismissShrinksPages(t *testing.T) {
+	store := &shrinkingUndeliverableStore{MockStore: &MockStore{}}
+	for i := 1; i <= 50; i++ {
+		store.messages = append(store.messages, Message{Id: strconv.Itoa(i)})
+	}
+	var mu sync.Mutex
+	handled := map[string]bool{}
+	s := &Settings{Undeliverable: &UndeliverableOptions{Workers: 1, DismissBatchSize: 5}}
+	p := s.undeliverableProcessor(store, func(ctx context.Context, m *Message) error {
+		// Slow enough that batches are dismissed while later pages would still be unread
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled[m.Id] = true
+		return nil
+	})
+
+	assert.NoError(t, p.processAllUndeliverableMessages(ctx, "hook1", "50"))
+	assert.Len(t, handled, 50, "no page is skipped when dismissals shrink the list")
+	assert.Empty(t, store.messages)
+}
+
+func TestProcessAllUndeliverableMessages_deadLetter(t *testing.T) {
+	store := &MockStore{}
+	page := &MessagePage{More: false, PageSize: 2, Items: []Message{{Id: "1"}, {Id: "2"}}}
+	store.On("GetUndeliverable", ctx, "hook1", 20, 1).Return(page, nil)
+	store.On("DismissUndeliverable", ctx, "hook1", []string{"1"}).Return(nil).Once()
+	store.On("DismissUndeliverable", ctx, "hook1", []string{"1", "2"}).Return(nil).Once()
+	deadLetters := NewMemoryDeadLetterStore()
+	s := &Settings{Undeliverable: &UndeliverableOptions{Workers: 1, MaxFailures: 2, DeadLetters: deadLetters}}
+	poison := true
+	h := func(ctx context.Context, m *Message) error {
+		if m.Id == "2" && poison {
+			return errors.New("poison")
+		}
+		return nil
+	}
+
+	assert.Error(t, s.undeliverableProcessor(store, h).processAllUndeliverableMessages(ctx, "hook1", "2"))
+	letters, _ := deadLetters.List(ctx)
+	assert.Empty(t, letters)
+
+	assert.NoError(t, s.undeliverableProcessor(store, h).processAllUndeliverableMessages(ctx, "hook1", "2"), "dead letters are dismissed")
+	letters, _ = deadLetters.List(ctx)
+	assert.Len(t, letters, 1)
+	assert.Equal(t, 2, letters[0].Attempts)
+	assert.Equal(t, "poison", letters[0].Error)
+	store.AssertExpectations(t)
+
+	retried, err := RetryDeadLetters(ctx, deadLetters, h)
+	assert.Error(t, err)
+	assert.Equal(t, 0, retried)
+	letters, _ = deadLetters.List(ctx)
+	assert.Equal(t, 3, letters[0].Attempts)
+
+	poison = false
+	retried, err = RetryDeadLetters(ctx, deadLetters, h, "2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, retried)
+	letters, _ = deadLetters.List(ctx)
+	assert.Empty(t, letters)
+}
@@ -0,0 +1,81 @@
+package eml
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type WebhookOption func(*webhookHandler)
+
+// WithTransactionHandler is required, it handles transaction messages and undeliverable messages unless WithUndeliverableHandler is set
+func WithTransactionHandler(h TransactionHandler) WebhookOption {
+	return func(w *webhookHandler) {
+		w.h = h
+	}
+}
+
+// WithUndeliverableHandler replaces the default processing of undeliverable_alert messages
+func WithUndeliverableHandler(uh TransactionHandler) WebhookOption {
+	return func(w *webhookHandler) {
+		w.uh = uh
+	}
+}
+
+// WithMessageHandler handles another message type, or replaces the default ping handler
+func WithMessageHandler(messageType TransactionType, h TransactionHandler) WebhookOption {
+	return func(w *webhookHandler) {
+		w.handlers[messageType] = h
+	}
+}
+
+// WithAsync acknowledges transaction messages once p has queued them, p.Run must be called to handle them
+func WithAsync(p *AsyncProcessor) WebhookOption {
+	return func(w *webhookHandler) {
+		w.h = p.Enqueue
+	}
+}
+
+type webhookHandler struct {
+	deps *Dependencies
+	h    TransactionHandler
+	uh   TransactionHandler
+	// Set by WithMessageHandler, overriding the defaults
+	handlers MessageHandlers
+}
+
+// NewWebhookHandler serves EML notifications through HandleNotificationByType, mapping errors to HTTP responses
+func NewWebhookHandler(deps *Dependencies, opts ...WebhookOption) http.Handler {
+	if deps == nil || deps.Config == nil {
+		panic("eml: NewWebhookHandler requires Dependencies with a Config")
+	}
+	w := &webhookHandler{deps: deps, handlers: MessageHandlers{}}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.h == nil {
+		panic("eml: NewWebhookHandler requires WithTransactionHandler or WithAsync")
+	}
+	extra := w.handlers
+	w.handlers = defaultMessageHandlers(deps, w.h, w.uh)
+	for messageType, h := range extra {
+		w.handlers[messageType] = h
+	}
+	return w
+}
+
+func (w *webhookHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	res := NewResponseWithLogger(rw, w.deps.logger())
+	if r.Method != http.MethodPost {
+		res.Header().Set("Allow", http.MethodPost)
+		res.HandleError(NewHttpError(http.StatusMethodNotAllowed, ErrorMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)))
+		return
+	}
+	req, err := NewRequest(r)
+	if err != nil {
+		res.HandleError(ContextualError(err, "NewRequest"))
+		return
+	}
+	if err := HandleNotificationByType(r.Context(), req, res, *w.deps, w.handlers); err != nil {
+		res.HandleError(err)
+	}
+}
@@ -0,0 +1,88 @@
+package eml
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewWebhookHandler_requires(t *testing.T) {
+	h := WithTransactionHandler(func(ctx context.Context, m *Message) error { return nil })
+	assert.Panics(t, func() { NewWebhookHandler(nil, h) })
+	assert.Panics(t, func() { NewWebhookHandler(&Dependencies{}, h) })
+	assert.Panics(t, func() { NewWebhookHandler(&Dependencies{Config: &Config{}}) })
+}
+
+func TestWebhookHandler_ServeHTTP(t *testing.T) {
+	var handled []string
+	deps := &Dependencies{Config: &Config{NotificationHookId: "hook1", HmacKey: testHmacKey}}
+	handler := NewWebhookHandler(deps, WithTransactionHandler(func(ctx context.Context, m *Message) error {
+		handled = append(handled, m.Id)
+		return nil
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/eml", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, http.MethodPost, rec.Header().Get("Allow"))
+
+	body := []byte(`{"id":"m1","hook_id":"hook1","data":{"eaid":"eaid1"}}`)
+	auth, err := SignMessage(testHmacKey, body)
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/eml", bytes.NewReader(body))
+	req.Header.Set(headerContentType, contentTypeJson)
+	req.Header.Set(headerEmlSpecification, "transaction@1.0.0")
+	req.Header.Set(headerActualAuth, auth)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"m1"}, handled)
+}
+
+func TestWebhookHandler_loadsHookState(t *testing.T) {
+	data := NewMemoryConfigStore()
+	assert.NoError(t, data.SaveHookState(ctx, &HookState{HookId: "hook1", HmacKey: testHmacKey}))
+	var handled []string
+	config := &Config{}
+	handler := NewWebhookHandler(&Dependencies{Config: config, Data: data}, WithTransactionHandler(func(ctx context.Context, m *Message) error {
+		handled = append(handled, m.Id)
+		return nil
+	}))
+
+	rec, err := serveMessage(NewWebhookTestClient(testHmacKey, "http://localhost/eml"), handler, testTxnMessage())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"m1"}, handled, "the saved hook ID and key are used")
+	assert.Empty(t, config.NotificationHookId, "the shared config isn't changed")
+}
+
+func TestWebhookHandler_loadsHookStateWithKeyRing(t *testing.T) {
+	now := time.Now()
+	ring := NewKeyRing(testHmacKey)
+	assert.NoError(t, ring.Retire(testHmacKey.Id, now.Add(-time.Minute)))
+	data := NewMemoryConfigStore()
+	assert.NoError(t, data.SaveHookState(ctx, &HookState{HookId: "hook1", HmacKey: testHmacKey}))
+	handler := NewWebhookHandler(&Dependencies{Config: &Config{HmacKeys: ring}, Data: data}, WithTransactionHandler(func(ctx context.Context, m *Message) error {
+		return nil
+	}))
+
+	client := NewWebhookTestClient(testHmacKey, "http://localhost/eml")
+	for i := 0; i < 2; i++ {
+		rec, err := serveMessage(client, handler, testTxnMessage())
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "the saved key doesn't bring back a retired one")
+	}
+	assert.Empty(t, ring.Ids(), "the shared ring isn't changed")
+
+	newKey := &Key{Id: "new", Secret: testHmacKey.Secret}
+	assert.NoError(t, data.SaveHookState(ctx, &HookState{HookId: "hook1", HmacKey: newKey}))
+	rec, err := serveMessage(NewWebhookTestClient(newKey, "http://localhost/eml"), handler, testTxnMessage())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code, "a saved key the ring doesn't have is accepted")
+	assert.Empty(t, ring.Ids())
+}